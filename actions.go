@@ -0,0 +1,385 @@
+package main
+
+/* Entry actions
+ *
+ * Changes to entries that are shared by the pages under /do and the JSON API. Each one checks
+ * whether the signed-in user is allowed to make the change, and returns the HTTP status code
+ * along with any error.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	NotAuthorized = errors.New("not logged in")
+	NotAllowed    = errors.New("not allowed to change this student's entries")
+	AdminOnly     = errors.New("admin permissions required")
+	InternalError = errors.New("internal error")
+)
+
+// Students can only add, change, and withdraw entries from the last 30 days; see Entry.Editable.
+const (
+	TOO_OLD_DATE     = "date must be within the last 30 days"
+	TOO_OLD_CHANGE   = "entries more than 30 days old can't be changed"
+	TOO_OLD_WITHDRAW = "entries more than 30 days old can't be withdrawn; ask for the entry to be deleted instead"
+)
+
+// Function AddEntry adds an entry for a student. Returns the entry's key.
+func AddEntry(student string, user User, entry *Entry) (string, uint16, error) {
+	if student == "" {
+		return "", 403, NotAllowed
+	}
+
+	if err := entry.Validate(); err != nil {
+		return "", 422, err
+	}
+
+	// Make sure entry is recent
+	if !user.Admin && !entry.Editable() {
+		return "", 422, ValidationError{"date": TOO_OLD_DATE}
+	}
+	entry.SetFlagged()
+	entry.Version = 1
+
+	key, err := database.Add(student, entry)
+	if err != nil {
+		log.Println(err)
+		return "", 500, InternalError
+	}
+
+	event := EntryEvent{APIEntry: APIEntry{Email: student, Key: key, Entry: entry}}
+	publish(EVENT_ENTRY_CREATED, user.Email, event)
+	if entry.Flagged {
+		publish(EVENT_ENTRY_FLAGGED, user.Email, event)
+	}
+	return key, 201, nil
+}
+
+// Function UpdateEntry replaces a student's entry. If check is set, the change is rejected with EntryConflict
+// when the entry was changed since entry.Version.
+func UpdateEntry(student string, user User, key string, entry *Entry, check bool) (uint16, error) {
+	if student == "" {
+		return 403, NotAllowed
+	}
+
+	if err := entry.Validate(); err != nil {
+		return 422, err
+	}
+
+	oldEntry, err := database.Get(student, key)
+	if err == EntryNotFound {
+		return 404, err
+	} else if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	// Make sure entry is recent
+	if !user.Admin && !oldEntry.Editable() {
+		return 422, ValidationError{"date": TOO_OLD_CHANGE}
+	}
+	if !user.Admin && !entry.Editable() {
+		return 422, ValidationError{"date": TOO_OLD_DATE}
+	}
+	entry.SetFlagged()
+
+	oldEntry, err = database.Set(student, key, entry, check)
+	if err == EntryNotFound {
+		return 404, err
+	} else if err == EntryConflict {
+		return 409, err
+	} else if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	event := EntryEvent{APIEntry: APIEntry{Email: student, Key: key, Entry: entry}, Previous: oldEntry}
+	publish(EVENT_ENTRY_UPDATED, user.Email, event)
+	if entry.Flagged && !oldEntry.Flagged {
+		publish(EVENT_ENTRY_FLAGGED, user.Email, event)
+	}
+	return 200, nil
+}
+
+// Function DeleteEntry moves a student's entry to the trash. Only Admin users may delete entries.
+func DeleteEntry(student string, user User, key string, reason string) (uint16, error) {
+	if student == "" {
+		return 403, NotAllowed
+	}
+	if !user.Admin {
+		return 403, AdminOnly
+	}
+
+	entry, err := database.Get(student, key)
+	if err == EntryNotFound {
+		return 404, err
+	} else if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	err = database.Trash(student, key, TrashedEntry{
+		Entry:     entry,
+		DeletedBy: user.Email,
+		Reason:    strings.TrimSpace(reason),
+		Deleted:   time.Now(),
+	})
+	if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	publish(EVENT_ENTRY_DELETED, user.Email, EntryEvent{APIEntry: APIEntry{Email: student, Key: key, Entry: entry}, Reason: strings.TrimSpace(reason)})
+	return 200, nil
+}
+
+// Function RestoreEntry moves a student's entry out of the trash. Only Admin users may restore entries.
+func RestoreEntry(student string, user User, key string) (uint16, error) {
+	if student == "" {
+		return 403, NotAllowed
+	}
+	if !user.Admin {
+		return 403, AdminOnly
+	}
+
+	trashed, err := database.Restore(student, key)
+	if err == EntryNotFound {
+		return 404, err
+	} else if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	publish(EVENT_ENTRY_RESTORED, user.Email, EntryEvent{APIEntry: APIEntry{Email: student, Key: key, Entry: trashed.Entry}})
+	return 200, nil
+}
+
+// Function PurgeEntry permanently deletes a student's entry from the trash. Only Admin users may purge entries.
+func PurgeEntry(student string, user User, key string) (uint16, error) {
+	if student == "" {
+		return 403, NotAllowed
+	}
+	if !user.Admin {
+		return 403, AdminOnly
+	}
+
+	trashed, err := database.Purge(student, key)
+	if err == EntryNotFound {
+		return 404, err
+	} else if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	publish(EVENT_ENTRY_PURGED, user.Email, EntryEvent{APIEntry: APIEntry{Email: student, Key: key, Entry: trashed.Entry}})
+	return 200, nil
+}
+
+// Function UnflagEntry marks a student's entry as not suspicious. Only Admin users may unflag entries.
+func UnflagEntry(student string, user User, key string) (uint16, error) {
+	if student == "" {
+		return 403, NotAllowed
+	}
+	if !user.Admin {
+		return 403, AdminOnly
+	}
+
+	entry, err := database.Get(student, key)
+	if err == EntryNotFound {
+		return 404, err
+	} else if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	err = database.Flag(student, key, false)
+	if err == EntryNotFound {
+		return 404, err
+	} else if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	entry.Flagged = false
+	entry.Version++
+	publish(EVENT_ENTRY_APPROVED, user.Email, EntryEvent{APIEntry: APIEntry{Email: student, Key: key, Entry: entry}})
+	return 200, nil
+}
+
+// Function AddComment adds a comment to a student's entry. The student and Admin users may comment.
+func AddComment(student string, user User, key string, text string) (Comment, uint16, error) {
+	if student == "" {
+		return Comment{}, 403, NotAllowed
+	}
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return Comment{}, 400, fmt.Errorf("comment is empty")
+	}
+	if len(text) > COMMENT_MAX_LENGTH {
+		return Comment{}, 400, fmt.Errorf("comment is longer than %d characters", COMMENT_MAX_LENGTH)
+	}
+
+	entry, err := database.Get(student, key)
+	if err == EntryNotFound {
+		return Comment{}, 404, err
+	} else if err != nil {
+		log.Println(err)
+		return Comment{}, 500, InternalError
+	}
+
+	comment := Comment{
+		Author:   user.Email,
+		Name:     user.Name,
+		Reviewer: user.Admin,
+		Text:     text,
+		Created:  time.Now(),
+	}
+	err = database.AddComment(student, key, &comment)
+	if err != nil {
+		log.Println(err)
+		return Comment{}, 500, InternalError
+	}
+
+	publish(EVENT_ENTRY_COMMENTED, user.Email, CommentEvent{Email: student, Key: key, Entry: entry, Comment: comment})
+	return comment, 201, nil
+}
+
+// Function WithdrawEntry moves a student's entry to the trash at their request. Students may only withdraw entries
+// that they can still edit; older entries need a deletion request, which an admin approves by withdrawing the entry.
+func WithdrawEntry(student string, user User, key string) (uint16, error) {
+	if student == "" {
+		return 403, NotAllowed
+	}
+
+	entry, err := database.Get(student, key)
+	if err == EntryNotFound {
+		return 404, err
+	} else if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	if !user.Admin && !entry.Editable() {
+		return 422, ValidationError{"date": TOO_OLD_WITHDRAW}
+	}
+
+	event := EntryEvent{APIEntry: APIEntry{Email: student, Key: key, Entry: entry}, Reason: WITHDRAWN_REASON}
+	if user.Email != student {
+		// An admin who withdraws an entry that the student asked to delete approves the request
+		req, ok, err := database.DeletionRequest(student, key)
+		if err != nil {
+			log.Println(err)
+			return 500, InternalError
+		}
+		if ok {
+			event.Reason = req.Reason
+			event.Request = true
+		}
+	}
+
+	err = database.Trash(student, key, TrashedEntry{
+		Entry:     entry,
+		DeletedBy: user.Email,
+		Reason:    event.Reason,
+		Deleted:   time.Now(),
+	})
+	if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	publish(EVENT_ENTRY_WITHDRAWN, user.Email, event)
+	return 200, nil
+}
+
+// Function RequestDeletion asks admins to delete a student's entry that is too old for the student to withdraw.
+func RequestDeletion(student string, user User, key string, reason string) (uint16, error) {
+	if student == "" {
+		return 403, NotAllowed
+	}
+
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return 400, fmt.Errorf("reason is missing")
+	}
+
+	entry, err := database.Get(student, key)
+	if err == EntryNotFound {
+		return 404, err
+	} else if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+	if entry.Editable() {
+		return 400, fmt.Errorf("entry can still be withdrawn")
+	}
+
+	err = database.SetDeletionRequest(DeletionRequest{Email: student, Key: key, Reason: reason, Requested: time.Now()})
+	if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	publish(EVENT_DELETION_REQUESTED, user.Email, EntryEvent{APIEntry: APIEntry{Email: student, Key: key, Entry: entry}, Reason: reason})
+	return 201, nil
+}
+
+// Function ReviewDeletion approves or denies a request to delete a student's entry. Approved entries are moved to
+// the trash. Only Admin users may review requests.
+func ReviewDeletion(student string, user User, key string, approve bool) (uint16, error) {
+	if student == "" {
+		return 403, NotAllowed
+	}
+	if !user.Admin {
+		return 403, AdminOnly
+	}
+
+	req, ok, err := database.DeletionRequest(student, key)
+	if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+	if !ok {
+		return 404, fmt.Errorf("deletion request not found")
+	}
+
+	entry, err := database.Get(student, key)
+	if err == EntryNotFound {
+		// The entry was deleted some other way
+		database.RemoveDeletionRequest(student, key)
+		return 404, err
+	} else if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+
+	event := EntryEvent{APIEntry: APIEntry{Email: student, Key: key, Entry: entry}, Reason: req.Reason, Request: true}
+	if !approve {
+		err = database.RemoveDeletionRequest(student, key)
+		if err != nil {
+			log.Println(err)
+			return 500, InternalError
+		}
+		publish(EVENT_DELETION_DENIED, user.Email, event)
+		return 200, nil
+	}
+
+	err = database.Trash(student, key, TrashedEntry{
+		Entry:     entry,
+		DeletedBy: user.Email,
+		Reason:    req.Reason,
+		Deleted:   time.Now(),
+	})
+	if err != nil {
+		log.Println(err)
+		return 500, InternalError
+	}
+	publish(EVENT_ENTRY_WITHDRAWN, user.Email, event)
+	return 200, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+/* JSON API
+ *
+ * Version 1 of the API is served under /api/v1. It follows the same rules as the pages: students can
+ * only see and change their own entries, and some routes are only available for Admin users. Errors are
+ * always sent as {"error": "..."}, even for paths and methods that the API doesn't have.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Alias APIHandlerFunc represents a handler function for the JSON API.
+//
+// The 1st argument is the student, 2nd is the logged-in user, 3rd is mux.Vars, and 4th is the original request.
+// The student is only passed if the user is an admin or the student themselves. The returned body is encoded as JSON;
+// if an error is returned, {"error": "..."} is sent instead. A ValidationError also sends {"fields": {...}}.
+type APIHandlerFunc = func(student string, user User, vars map[string]string, r *http.Request) (code uint16, body interface{}, err error)
+
+// Type APIHandler is a Handler that is used for the JSON API. It always requires authentication.
+type APIHandler struct {
+	Func         APIHandlerFunc
+	RequireAdmin bool
+}
+
+func NewAPIHandler(reqAdmin bool, fn APIHandlerFunc) APIHandler {
+	return APIHandler{
+		Func:         fn,
+		RequireAdmin: reqAdmin,
+	}
+}
+
+var (
+	APIForbidden   = errors.New("forbidden")
+	APINotJSON     = errors.New("request body must be JSON")
+	APIInvalidJSON = errors.New("request body is not valid JSON")
+	APINotFound    = errors.New("not found")
+	APINoMethod    = errors.New("method not allowed")
+	APINoIfMatch   = errors.New("If-Match is required; send the entry's ETag, or * to replace any version")
+)
+
+// writes a JSON response.
+func apiWrite(w http.ResponseWriter, code uint16, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(code))
+	if code == 204 {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("error encoding JSON: %s", err)
+	}
+}
+
+func (h APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, err := authenticate(r)
+	if err != nil {
+		apiWrite(w, uint16(authStatus(err)), map[string]string{"error": err.Error()})
+		return
+	}
+
+	if h.RequireAdmin && !user.Admin {
+		apiWrite(w, 403, map[string]string{"error": AdminOnly.Error()})
+		return
+	}
+
+	vars := mux.Vars(r)
+	student := ""
+	if user.Admin || user.Email == vars["email"] {
+		student = vars["email"]
+	}
+	if vars["email"] != "" && student == "" {
+		apiWrite(w, 403, map[string]string{"error": APIForbidden.Error()})
+		return
+	}
+
+	code, body, err := h.Func(student, user, vars, r)
+	if problems, ok := err.(ValidationError); ok {
+		apiWrite(w, code, map[string]interface{}{"error": err.Error(), "fields": problems})
+		return
+	} else if err != nil {
+		apiWrite(w, code, map[string]string{"error": err.Error()})
+		return
+	}
+	// An entry's version is its ETag, which is sent back in If-Match to replace it
+	if entry, ok := body.(APIEntry); ok && entry.Entry != nil {
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, entry.Entry.Version))
+	}
+	apiWrite(w, code, body)
+}
+
+// Function AddAPIRoutes adds the routes of the JSON API and the OpenAPI document to a router. Paths under /api/ that
+// aren't routes, and methods that a route doesn't have, get JSON errors too.
+func AddAPIRoutes(r *mux.Router, spec map[string]interface{}) {
+	prefix := r.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		return strings.HasPrefix(r.URL.Path, "/api/")
+	})
+	api := prefix.Subrouter()
+
+	for _, route := range apiRoutes {
+		api.Handle(route.Path, route.Handler).Methods(route.Method)
+	}
+	api.Handle(OPENAPI_PATH, OpenAPIHandler(spec)).Methods("GET")
+
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiWrite(w, 404, map[string]string{"error": APINotFound.Error()})
+	})
+	noMethod := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiWrite(w, 405, map[string]string{"error": APINoMethod.Error()})
+	})
+	api.MethodNotAllowedHandler = noMethod
+	// When a subrouter's method doesn't match, mux uses the handler of its parent route instead
+	prefix.Handler(noMethod)
+}
+
+// decodes a JSON request body.
+func apiDecode(r *http.Request, v interface{}) (uint16, error) {
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediatype != "application/json" {
+		return 415, APINotJSON
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return 400, APIInvalidJSON
+	}
+	return 200, nil
+}
+
+// Type APITotal is a student's hours, as returned by the API.
+type APITotal struct {
+	Email    string `json:"email"`
+	Total    uint   `json:"total"`
+	Approved uint   `json:"approved"`
+	Required uint   `json:"required"`
+}
+
+// Type APIEntry is an entry along with who it belongs to, as returned by the API.
+type APIEntry struct {
+	Email string `json:"email"`
+	Key   string `json:"key"`
+	Entry *Entry `json:"entry"`
+}
+
+// returns the entry as it may be shown to a user. Non-Admin users can't view the Flagged field.
+func apiShow(user User, entry *Entry) *Entry {
+	if user.Admin || !entry.Flagged {
+		return entry
+	}
+	shown := *entry
+	shown.Flagged = false
+	return &shown
+}
+
+// Type APIRoute is a route of the JSON API. Request and Response are values of the types of the request and response
+// bodies, which are used to generate the OpenAPI document; nil means there is no body.
+type APIRoute struct {
+	Method   string
+	Path     string
+	Summary  string
+	Request  interface{}
+	Response interface{}
+	Handler  APIHandler
+}
+
+var apiRoutes = []APIRoute{
+	{"GET", "/api/v1/users", "List users", nil, []User{}, NewAPIHandler(true, func(student string, user User, vars map[string]string, r *http.Request) (uint16, interface{}, error) {
+		users, err := database.Users()
+		if err != nil {
+			log.Println(err)
+			return 500, nil, InternalError
+		}
+
+		list := make([]User, 0, len(users))
+		for _, u := range users {
+			list = append(list, u)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Email < list[j].Email
+		})
+		return 200, list, nil
+	})},
+
+	{"GET", "/api/v1/users/{email}", "Get a user", nil, User{}, NewAPIHandler(false, func(student string, user User, vars map[string]string, r *http.Request) (uint16, interface{}, error) {
+		studentInfo, ok := database.UserExists(student)
+		if !ok {
+			return 404, nil, APINotFound
+		}
+		return 200, studentInfo, nil
+	})},
+
+	{"GET", "/api/v1/users/{email}/total", "Get a student's hours", nil, APITotal{}, NewAPIHandler(false, func(student string, user User, vars map[string]string, r *http.Request) (uint16, interface{}, error) {
+		entries, err := database.List(student)
+		if err != nil {
+			log.Println(err)
+			return 500, nil, InternalError
+		}
+
+		studentInfo := database.User(student)
+		total := APITotal{Email: student, Total: entries.Total(), Approved: entries.Approved()}
+		if studentInfo.Grade != 0 {
+			total.Required = studentInfo.Required()
+		}
+		return 200, total, nil
+	})},
+
+	{"GET", "/api/v1/users/{email}/entries", "List a student's entries", nil, EntryList{}, NewAPIHandler(false, func(student string, user User, vars map[string]string, r *http.Request) (uint16, interface{}, error) {
+		entries, err := database.List(student)
+		if err != nil {
+			log.Println(err)
+			return 500, nil, InternalError
+		}
+		for key, entry := range entries {
+			entries[key] = apiShow(user, entry)
+		}
+		return 200, entries, nil
+	})},
+
+	{"POST", "/api/v1/users/{email}/entries", "Add an entry", &Entry{}, APIEntry{}, NewAPIHandler(false, func(student string, user User, vars map[string]string, r *http.Request) (uint16, interface{}, error) {
+		entry := EmptyEntry()
+		if status, err := apiDecode(r, entry); err != nil {
+			return status, nil, err
+		}
+		entry.LastModified = time.Now()
+
+		key, status, err := AddEntry(student, user, entry)
+		if err != nil {
+			return status, nil, err
+		}
+		return 201, APIEntry{Email: student, Key: key, Entry: apiShow(user, entry)}, nil
+	})},
+
+	{"GET", "/api/v1/users/{email}/entries/{key}", "Get an entry", nil, APIEntry{}, NewAPIHandler(false, func(student string, user User, vars map[string]string, r *http.Request) (uint16, interface{}, error) {
+		entry, err := database.Get(student, vars["key"])
+		if err == EntryNotFound {
+			return 404, nil, err
+		} else if err != nil {
+			log.Println(err)
+			return 500, nil, InternalError
+		}
+		return 200, APIEntry{Email: student, Key: vars["key"], Entry: apiShow(user, entry)}, nil
+	})},
+
+	{"PUT", "/api/v1/users/{email}/entries/{key}", "Replace an entry", &Entry{}, APIEntry{}, NewAPIHandler(false, func(student string, user User, vars map[string]string, r *http.Request) (uint16, interface{}, error) {
+		entry := EmptyEntry()
+		if status, err := apiDecode(r, entry); err != nil {
+			return status, nil, err
+		}
+		entry.LastModified = time.Now()
+
+		// If-Match holds the version that the change was made to, or * to replace whatever version there is
+		match := r.Header.Get("If-Match")
+		if match == "" {
+			return 428, nil, APINoIfMatch
+		}
+		check := false
+		if match != "*" {
+			version, err := strconv.ParseUint(strings.Trim(match, `"`), 10, 64)
+			if err != nil {
+				return 400, nil, fmt.Errorf("invalid If-Match: '%v'", match)
+			}
+			entry.Version = uint(version)
+			check = true
+		}
+
+		status, err := UpdateEntry(student, user, vars["key"], entry, check)
+		if err == EntryConflict {
+			return 412, nil, err
+		} else if err != nil {
+			return status, nil, err
+		}
+		return 200, APIEntry{Email: student, Key: vars["key"], Entry: apiShow(user, entry)}, nil
+	})},
+
+	{"DELETE", "/api/v1/users/{email}/entries/{key}", "Delete an entry", nil, nil, NewAPIHandler(true, func(student string, user User, vars map[string]string, r *http.Request) (uint16, interface{}, error) {
+		status, err := DeleteEntry(student, user, vars["key"], r.URL.Query().Get("reason"))
+		if err != nil {
+			return status, nil, err
+		}
+		return 204, nil, nil
+	})},
+
+	{"POST", "/api/v1/users/{email}/entries/{key}/unflag", "Mark an entry as not suspicious", nil, nil, NewAPIHandler(true, func(student string, user User, vars map[string]string, r *http.Request) (uint16, interface{}, error) {
+		status, err := UnflagEntry(student, user, vars["key"])
+		if err != nil {
+			return status, nil, err
+		}
+		return 204, nil, nil
+	})},
+
+	{"GET", "/api/v1/totals", "List every student's hours", nil, []APITotal{}, NewAPIHandler(true, func(student string, user User, vars map[string]string, r *http.Request) (uint16, interface{}, error) {
+		users, err := database.Users()
+		if err != nil {
+			log.Println(err)
+			return 500, nil, InternalError
+		}
+		entries, err := database.ListAll()
+		if err != nil {
+			log.Println(err)
+			return 500, nil, InternalError
+		}
+
+		totals := []APITotal{}
+		for email, u := range users {
+			if u.Grade == 0 {
+				continue
+			}
+			totals = append(totals, APITotal{
+				Email:    email,
+				Total:    entries[email].Total(),
+				Approved: entries[email].Approved(),
+				Required: u.Required(),
+			})
+		}
+		sort.Slice(totals, func(i, j int) bool {
+			return totals[i].Email < totals[j].Email
+		})
+		return 200, totals, nil
+	})},
+
+	{"GET", "/api/v1/flagged", "List suspicious entries", nil, []APIEntry{}, NewAPIHandler(true, func(student string, user User, vars map[string]string, r *http.Request) (uint16, interface{}, error) {
+		flagged, err := database.Flagged()
+		if err != nil {
+			log.Println(err)
+			return 500, nil, InternalError
+		}
+
+		list := []APIEntry{}
+		for id, entry := range flagged {
+			list = append(list, APIEntry{Email: id[0], Key: id[1], Entry: entry})
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Entry.Date.After(list[j].Entry.Date)
+		})
+		return 200, list, nil
+	})},
+}
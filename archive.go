@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ARCHIVE_GRADUATED = "graduated"
+	ARCHIVE_WITHDRAWN = "withdrawn"
+)
+
+// Type ArchivedUser is a student who is no longer on the roster. Their entries are kept until they are purged.
+type ArchivedUser struct {
+	User
+	Reason   string    `json:"reason"` // ARCHIVE_GRADUATED or ARCHIVE_WITHDRAWN
+	Archived time.Time `json:"archived"`
+}
+
+// Function ArchiveUser archives a user who was removed from the roster at a given instant. Students whose class
+// graduates in the current school year or earlier have graduated, since seniors leave the roster before July.
+func ArchiveUser(user User, t time.Time) ArchivedUser {
+	reason := ARCHIVE_WITHDRAWN
+	if user.Grade != 0 && user.Grade <= ClassOf(12, t) {
+		reason = ARCHIVE_GRADUATED
+	}
+	return ArchivedUser{
+		User:     user,
+		Reason:   reason,
+		Archived: t,
+	}
+}
+
+// Method Expired returns whether the user has been archived for longer than the retention period.
+func (u ArchivedUser) Expired(retention time.Duration, t time.Time) bool {
+	return t.Sub(u.Archived) > retention
+}
+
+// Function SearchArchive returns the archived users whose name or email contains the query and whose reason
+// matches (if given), sorted by name.
+func SearchArchive(archive map[string]ArchivedUser, query string, reason string) []ArchivedUser {
+	query = strings.ToLower(strings.TrimSpace(query))
+	out := []ArchivedUser(nil)
+	for _, user := range archive {
+		if reason != "" && user.Reason != reason {
+			continue
+		}
+		if query != "" && !strings.Contains(strings.ToLower(user.Name), query) && !strings.Contains(strings.ToLower(user.Email), query) {
+			continue
+		}
+		out = append(out, user)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
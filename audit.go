@@ -0,0 +1,316 @@
+package main
+
+/* Audit trail
+ *
+ * Every change to an entry or the roster, and every comment, is recorded in the audit log along with who made it,
+ * when, and what changed. Records are made from events, and they are never changed or deleted. Admins can search
+ * the log for a student, an entry, an actor, a kind of change, or a range of dates.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Type AuditChange is a field that changed. Empty values mean that the field was not set.
+type AuditChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// Type AuditRecord is a change in the audit log.
+type AuditRecord struct {
+	ID      string        `json:"-"`
+	Action  string        `json:"action"` // Type of the event
+	Actor   string        `json:"actor"`
+	Time    time.Time     `json:"time"`
+	Student string        `json:"student"`           // Email of the student at the time
+	UserID  string        `json:"user_id,omitempty"` // ID of the student, which is kept when their email changes
+	Key     string        `json:"key,omitempty"`     // Key of the entry
+	Entry   string        `json:"entry,omitempty"`   // Name of the entry, which is kept after it is deleted
+	Changes []AuditChange `json:"changes,omitempty"`
+	Note    string        `json:"note,omitempty"` // Text of a comment, why an entry was deleted, or how the roster changed
+}
+
+// Records shown on the Audit Log page; the CSV export has every record
+const AUDIT_PAGE_SIZE = 500
+
+// How the roster changed for a student
+const (
+	AUDIT_ADDED   = "added"
+	AUDIT_REMOVED = "removed"
+	AUDIT_CHANGED = "changed"
+)
+
+// Method Description describes the action in words.
+func (r AuditRecord) Description() string {
+	switch r.Action {
+	case EVENT_ENTRY_CREATED:
+		return "Added entry"
+	case EVENT_ENTRY_UPDATED:
+		return "Changed entry"
+	case EVENT_ENTRY_FLAGGED:
+		return "Flagged entry"
+	case EVENT_ENTRY_APPROVED:
+		return "Unflagged entry"
+	case EVENT_ENTRY_DELETED:
+		return "Deleted entry"
+	case EVENT_ENTRY_RESTORED:
+		return "Restored entry"
+	case EVENT_ENTRY_PURGED:
+		return "Purged entry"
+	case EVENT_ENTRY_WITHDRAWN:
+		return "Withdrew entry"
+	case EVENT_DELETION_REQUESTED:
+		return "Requested deletion"
+	case EVENT_DELETION_DENIED:
+		return "Denied deletion request"
+	case EVENT_ENTRY_COMMENTED:
+		return "Commented"
+	case EVENT_ROSTER_UPDATED:
+		switch r.Note {
+		case AUDIT_ADDED:
+			return "Added to roster"
+		case AUDIT_REMOVED:
+			return "Removed from roster"
+		}
+		return "Changed on roster"
+	}
+	return r.Action
+}
+
+// returns the fields of a value as they are stored, with every value as a string.
+func auditFields(v interface{}) map[string]string {
+	out := make(map[string]string)
+	data, err := json.Marshal(v)
+	if err != nil {
+		return out
+	}
+	m := make(map[string]interface{})
+	json.Unmarshal(data, &m)
+	for field, value := range m {
+		if value != nil && value != false && value != "" && value != float64(0) {
+			out[field] = fmt.Sprint(value)
+		}
+	}
+	return out
+}
+
+// returns the fields that differ between two values, sorted by name.
+func auditDiff(before map[string]string, after map[string]string, ignore ...string) []AuditChange {
+	fields := make(map[string]bool)
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range after {
+		fields[field] = true
+	}
+	for _, field := range ignore {
+		delete(fields, field)
+	}
+
+	changes := []AuditChange(nil)
+	for field := range fields {
+		if before[field] != after[field] {
+			changes = append(changes, AuditChange{Field: field, Before: before[field], After: after[field]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes
+}
+
+// Function EntryDiff returns the fields that differ between two versions of an entry. Either may be nil.
+func EntryDiff(before *Entry, after *Entry) []AuditChange {
+	fields := func(entry *Entry) map[string]string {
+		if entry == nil {
+			return nil
+		}
+		return auditFields(entry)
+	}
+	return auditDiff(fields(before), fields(after), "last_modified")
+}
+
+// Function UserDiff returns the fields that differ between two versions of a user. Either may be nil.
+func UserDiff(before *User, after *User) []AuditChange {
+	fields := func(user *User) map[string]string {
+		if user == nil {
+			return nil
+		}
+		return auditFields(user)
+	}
+	return auditDiff(fields(before), fields(after))
+}
+
+// Function AuditRecords returns the records of an event.
+func AuditRecords(event Event) []AuditRecord {
+	record := AuditRecord{Action: event.Type, Actor: event.Actor, Time: event.Time}
+
+	switch data := event.Data.(type) {
+	case EntryEvent:
+		record.Student = data.Email
+		record.Key = data.Key
+		record.Entry = data.Entry.Name
+		switch event.Type {
+		case EVENT_ENTRY_CREATED:
+			record.Changes = EntryDiff(nil, data.Entry)
+		case EVENT_ENTRY_UPDATED:
+			record.Changes = EntryDiff(data.Previous, data.Entry)
+		case EVENT_ENTRY_FLAGGED:
+			record.Changes = []AuditChange{{Field: "flagged", After: "true"}}
+		case EVENT_ENTRY_APPROVED:
+			record.Changes = []AuditChange{{Field: "flagged", Before: "true"}}
+		case EVENT_ENTRY_DELETED, EVENT_ENTRY_WITHDRAWN:
+			record.Changes = EntryDiff(data.Entry, nil)
+		}
+		record.Note = data.Reason
+		return []AuditRecord{record}
+	case CommentEvent:
+		record.Student = data.Email
+		record.Key = data.Key
+		record.Entry = data.Entry.Name
+		record.Note = data.Comment.Text
+		return []AuditRecord{record}
+	case RosterEvent:
+		records := []AuditRecord(nil)
+		add := func(email string, note string, before *User, after *User) {
+			r := record
+			r.Student = email
+			r.Note = note
+			r.Changes = UserDiff(before, after)
+			records = append(records, r)
+		}
+		before := func(email string) *User {
+			if user, ok := data.Previous[email]; ok {
+				return &user
+			}
+			return nil
+		}
+		after := func(email string) *User {
+			if user, ok := data.Current[email]; ok {
+				return &user
+			}
+			return nil
+		}
+		for _, email := range data.Added {
+			add(email, AUDIT_ADDED, nil, after(email))
+		}
+		for _, email := range data.Removed {
+			add(email, AUDIT_REMOVED, before(email), nil)
+		}
+		for _, email := range data.Changed {
+			add(email, AUDIT_CHANGED, before(email), after(email))
+		}
+		return records
+	}
+	return nil
+}
+
+// records events in the audit log.
+func recordAuditEvent(event Event) {
+	records := AuditRecords(event)
+	if len(records) == 0 {
+		return
+	}
+	if err := database.AddAuditRecords(records); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// Type AuditQuery is a search of the audit log. Empty fields match every record.
+type AuditQuery struct {
+	Student string
+	Key     string
+	Actor   string
+	Action  string
+	Since   time.Time
+	Until   time.Time // Exclusive
+}
+
+// Function AuditQueryFromQuery reads a search from the form on the Audit Log page. Dates are inclusive.
+func AuditQueryFromQuery(query url.Values, loc *time.Location) (AuditQuery, error) {
+	q := AuditQuery{
+		Student: strings.TrimSpace(query.Get("student")),
+		Key:     strings.TrimSpace(query.Get("entry")),
+		Actor:   strings.TrimSpace(query.Get("actor")),
+		Action:  query.Get("action"),
+	}
+	if q.Action != "" {
+		found := false
+		for _, t := range EventTypes {
+			found = found || t == q.Action
+		}
+		if !found {
+			return q, fmt.Errorf("invalid action: '%v'", q.Action)
+		}
+	}
+
+	var err error
+	if query.Get("since") != "" {
+		q.Since, err = time.ParseInLocation("2006-01-02", query.Get("since"), loc)
+		if err != nil {
+			return q, fmt.Errorf("invalid date: '%v'", query.Get("since"))
+		}
+	}
+	if query.Get("until") != "" {
+		q.Until, err = time.ParseInLocation("2006-01-02", query.Get("until"), loc)
+		if err != nil {
+			return q, fmt.Errorf("invalid date: '%v'", query.Get("until"))
+		}
+		q.Until = q.Until.AddDate(0, 0, 1)
+	}
+	return q, nil
+}
+
+// Method Matches returns whether a record matches the search. The student's ID is used to match records from
+// before their email changed; it may be empty.
+func (q AuditQuery) Matches(r AuditRecord, studentID string) bool {
+	if q.Student != "" && !strings.EqualFold(r.Student, q.Student) && (studentID == "" || r.UserID != studentID) {
+		return false
+	}
+	if q.Key != "" && r.Key != q.Key {
+		return false
+	}
+	if q.Actor != "" && !strings.EqualFold(r.Actor, q.Actor) {
+		return false
+	}
+	if q.Action != "" && r.Action != q.Action {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Function AuditCSV converts audit records into CSV records, including a header.
+func AuditCSV(records []AuditRecord) [][]string {
+	out := [][]string{{"Time", "Actor", "Student", "Entry Key", "Entry", "Action", "Changes", "Note"}}
+	for _, r := range records {
+		changes := make([]string, len(r.Changes))
+		for i, c := range r.Changes {
+			changes[i] = fmt.Sprintf("%s: %q -> %q", c.Field, c.Before, c.After)
+		}
+		out = append(out, []string{
+			r.Time.Format(time.RFC3339),
+			r.Actor,
+			r.Student,
+			r.Key,
+			r.Entry,
+			r.Description(),
+			strings.Join(changes, "; "),
+			r.Note,
+		})
+	}
+	return out
+}
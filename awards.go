@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type AwardTier is an award level that students of a given age qualify for by doing enough hours within 12 months.
+type AwardTier struct {
+	Name   string `json:"name"`
+	MinAge uint   `json:"min_age"`
+	MaxAge uint   `json:"max_age"`
+	Hours  uint   `json:"hours"`
+}
+
+// The Presidential Volunteer Service Award levels for teens and young adults.
+var DefaultAwardTiers = []AwardTier{
+	{"Bronze", 11, 15, 50},
+	{"Silver", 11, 15, 75},
+	{"Gold", 11, 15, 100},
+	{"Bronze", 16, 25, 100},
+	{"Silver", 16, 25, 175},
+	{"Gold", 16, 25, 250},
+}
+
+// Method AgeAt estimates how old the user is at a given instant from their grade, since birthdays are not on the roster.
+// Students are assumed to be 14 at the start of 9th grade and to have their birthday by January.
+func (u User) AgeAt(t time.Time) uint {
+	if u.Grade == 0 {
+		return 0
+	}
+	age := u.GradeAt(t) + 5
+	if t.Month() < time.July {
+		age += 1
+	}
+	return age
+}
+
+// Method Between returns the total approved hours of entries dated after from and up to to.
+func (l EntryList) Between(from time.Time, to time.Time) uint {
+	total := uint(0)
+	for _, entry := range l {
+		if !entry.Flagged && entry.Date.After(from) && !entry.Date.After(to) {
+			total += entry.Hours
+		}
+	}
+	return total
+}
+
+// Function AwardFor returns the highest award tier for the given age and hours, or nil if none apply.
+func AwardFor(tiers []AwardTier, age uint, hours uint) *AwardTier {
+	var best *AwardTier
+	for i, tier := range tiers {
+		if age < tier.MinAge || age > tier.MaxAge || hours < tier.Hours {
+			continue
+		}
+		if best == nil || tier.Hours > best.Hours {
+			best = &tiers[i]
+		}
+	}
+	return best
+}
+
+// Type Nomination is a student who qualifies for an award.
+type Nomination struct {
+	Student User
+	Age     uint
+	Hours   uint // Approved hours in the 12 months before the nomination
+	Award   AwardTier
+}
+
+// Function StudentAward returns the award a student qualifies for at a given instant and their hours in the past 12 months.
+func StudentAward(tiers []AwardTier, user User, entries EntryList, t time.Time) (*AwardTier, uint) {
+	hours := entries.Between(t.AddDate(-1, 0, 0), t)
+	return AwardFor(tiers, user.AgeAt(t), hours), hours
+}
+
+// Function Nominations returns every student who qualifies for an award at a given instant, sorted by name.
+func Nominations(tiers []AwardTier, users map[string]User, entries map[string]EntryList, t time.Time) []Nomination {
+	out := []Nomination(nil)
+	for email, user := range users {
+		if user.Grade == 0 {
+			continue
+		}
+		award, hours := StudentAward(tiers, user, entries[email], t)
+		if award == nil {
+			continue
+		}
+		out = append(out, Nomination{
+			Student: user,
+			Age:     user.AgeAt(t),
+			Hours:   hours,
+			Award:   *award,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Student.Name < out[j].Student.Name
+	})
+	return out
+}
+
+// Function NominationRecords converts nominations into CSV records, including a header.
+func NominationRecords(nominations []Nomination) [][]string {
+	records := [][]string{{"Name", "Email", "Graduation Year", "Estimated Age", "Hours", "Award"}}
+	for _, n := range nominations {
+		records = append(records, []string{
+			n.Student.Name,
+			n.Student.Email,
+			fmt.Sprint(n.Student.Grade),
+			fmt.Sprint(n.Age),
+			fmt.Sprint(n.Hours),
+			n.Award.Name,
+		})
+	}
+	return records
+}
+
+// Function AwardTiersFromCSV parses award tiers with the columns name, minimum age, maximum age, hours. There must
+// be at least one tier.
+func AwardTiersFromCSV(r io.Reader) ([]AwardTier, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) != 0 && len(records[0]) != 0 && strings.EqualFold(records[0][0], "Name") {
+		records = records[1:]
+	}
+
+	out := []AwardTier(nil)
+	for _, record := range records {
+		if len(record) != 4 {
+			return nil, fmt.Errorf("wrong number of fields")
+		}
+
+		tier := AwardTier{Name: strings.TrimSpace(record[0])}
+		values := []*uint{&tier.MinAge, &tier.MaxAge, &tier.Hours}
+		for i, value := range values {
+			n, err := strconv.ParseUint(strings.TrimSpace(record[i+1]), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number: '%v'", record[i+1])
+			}
+			*value = uint(n)
+		}
+
+		if tier.Name == "" {
+			return nil, fmt.Errorf("award name is missing")
+		}
+		if tier.MinAge > tier.MaxAge {
+			return nil, fmt.Errorf("minimum age of %v is greater than maximum age", tier.Name)
+		}
+		out = append(out, tier)
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no award tiers")
+	}
+	return out, nil
+}
+
+// Function AwardTiersCSV formats award tiers in the format read by AwardTiersFromCSV.
+func AwardTiersCSV(tiers []AwardTier) string {
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+	w.Write([]string{"Name", "Min Age", "Max Age", "Hours"})
+	for _, tier := range tiers {
+		w.Write([]string{tier.Name, fmt.Sprint(tier.MinAge), fmt.Sprint(tier.MaxAge), fmt.Sprint(tier.Hours)})
+	}
+	w.Flush()
+	return buf.String()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	CERT_PENDING   = ""
+	CERT_CERTIFIED = "certified"
+	CERT_HELD      = "held"
+)
+
+// Type Certification records an admin's decision about whether a student has met the service requirement.
+type Certification struct {
+	Status string    `json:"status"` // CERT_CERTIFIED or CERT_HELD
+	By     string    `json:"by"`     // Email of the admin who made the decision
+	Date   time.Time `json:"date"`
+	Note   string    `json:"note,omitempty"`
+}
+
+// Type CompletionRow is one student's line of a class completion report.
+type CompletionRow struct {
+	Student       User
+	Approved      uint
+	Required      uint
+	Certification Certification
+}
+
+// Method Met returns whether the student's approved hours meet their requirement.
+func (row CompletionRow) Met() bool {
+	return row.Approved >= row.Required
+}
+
+// Function CompletionReport builds the completion report for the students graduating in a given year,
+// sorted by name.
+func CompletionReport(class uint, users map[string]User, entries map[string]EntryList, certs map[string]Certification) []CompletionRow {
+	rows := []CompletionRow(nil)
+	for email, user := range users {
+		if user.Admin || user.Grade != class {
+			continue
+		}
+		rows = append(rows, CompletionRow{
+			Student:       user,
+			Approved:      entries[email].Approved(),
+			Required:      user.RequiredBy(12),
+			Certification: certs[email],
+		})
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Student.Name < rows[j].Student.Name
+	})
+	return rows
+}
+
+// Function CompletionRecords converts a completion report into CSV records, including a header.
+func CompletionRecords(rows []CompletionRow) [][]string {
+	records := [][]string{{"Name", "Email", "Graduation Year", "Approved Hours", "Required Hours", "Met", "Status", "Certified By", "Date", "Note"}}
+	for _, row := range rows {
+		status := row.Certification.Status
+		date := ""
+		if status == CERT_PENDING {
+			status = "pending"
+		} else {
+			date = row.Certification.Date.Format("2006-01-02")
+		}
+		records = append(records, []string{
+			row.Student.Name,
+			row.Student.Email,
+			fmt.Sprint(row.Student.Grade),
+			fmt.Sprint(row.Approved),
+			fmt.Sprint(row.Required),
+			fmt.Sprint(row.Met()),
+			status,
+			row.Certification.By,
+			date,
+			row.Certification.Note,
+		})
+	}
+	return records
+}
@@ -0,0 +1,42 @@
+package main
+
+/* Comments
+ *
+ * Students and reviewers can discuss an entry in a thread of comments on its page, for example when an admin
+ * needs more information before approving it. Comments are stored apart from the entry, so they are kept when
+ * the entry is changed or deleted.
+ */
+
+import (
+	"time"
+)
+
+const COMMENT_MAX_LENGTH = 2000
+
+// Type Comment is a comment on an entry.
+type Comment struct {
+	ID       string    `json:"-"`
+	Author   string    `json:"author"`             // Email
+	Name     string    `json:"name"`               // Name of the author when they commented
+	Reviewer bool      `json:"reviewer,omitempty"` // Whether the author was an admin
+	Text     string    `json:"text"`
+	Created  time.Time `json:"created"`
+}
+
+// Function CommentRecipients returns who is notified of a comment on a student's entry: the student, and every
+// reviewer who commented in the thread before, except the author.
+func CommentRecipients(student string, comment Comment, thread []Comment) []string {
+	seen := map[string]bool{comment.Author: true}
+	out := []string(nil)
+	if !seen[student] {
+		seen[student] = true
+		out = append(out, student)
+	}
+	for _, c := range thread {
+		if c.Reviewer && !seen[c.Author] {
+			seen[c.Author] = true
+			out = append(out, c.Author)
+		}
+	}
+	return out
+}
@@ -7,17 +7,24 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"firebase.google.com/go"
 	"firebase.google.com/go/db"
 	"fmt"
 	"google.golang.org/api/option"
 	"path"
+	"sort"
 	"strings"
+	"time"
 )
 
 var EntryNotFound = errors.New("entry not found")
 
+var EntryConflict = errors.New("entry was changed by someone else")
+
 func dbCodeEmail(email string) string {
 	return strings.Replace(email, ".", "^", -1)
 }
@@ -26,6 +33,17 @@ func dbDecodeEmail(code string) string {
 	return strings.Replace(code, "^", ".", -1)
 }
 
+/* User IDs
+ *
+ * Users, archived users, entries, and certifications are keyed by an ID that never changes, so that
+ * a student keeps their history when their email changes. The index at /emails maps each email to an ID.
+ */
+
+// returns a new user ID.
+func dbNewID() string {
+	return randomToken()[:20]
+}
+
 // Type Database might be thread-safe. We don't know.
 type Database struct {
 	app *firebase.App
@@ -51,10 +69,184 @@ func NewDatabase(configFile string, databaseURL string) (*Database, error) {
 	}, nil
 }
 
+// returns the ID of a user, or an empty string if the email has never been seen.
+func (dab *Database) userID(email string) string {
+	id := ""
+	dab.db.NewRef("/emails").Child(dbCodeEmail(email)).Get(dab.ctx, &id)
+	return id
+}
+
+// returns the ID of a user, creating one if the email has never been seen.
+func (dab *Database) ensureUserID(email string) (string, error) {
+	id := ""
+	err := dab.db.NewRef("/emails").Child(dbCodeEmail(email)).Transaction(dab.ctx, db.UpdateFn(func(node db.TransactionNode) (interface{}, error) {
+		err := node.Unmarshal(&id)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			id = dbNewID()
+		}
+		return id, nil
+	}))
+	return id, err
+}
+
+// returns the email index, mapping emails to IDs.
+func (dab *Database) emailIndex() (map[string]string, error) {
+	coded := make(map[string]string)
+	err := dab.db.NewRef("/emails").OrderByKey().Get(dab.ctx, &coded)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]string, len(coded))
+	for codedEmail, id := range coded {
+		index[dbDecodeEmail(codedEmail)] = id
+	}
+	return index, nil
+}
+
+// returns the email index reversed, mapping IDs to emails.
+func (dab *Database) emailsByID() (map[string]string, error) {
+	index, err := dab.emailIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	emails := make(map[string]string, len(index))
+	for email, id := range index {
+		emails[id] = email
+	}
+	return emails, nil
+}
+
+// Method Migrate moves users, archived users, entries, and certifications that are still keyed by email to user IDs,
+// and converts contact phone numbers that are still stored as integers. It does nothing if there is nothing to
+// migrate.
+func (dab *Database) Migrate() error {
+	index, err := dab.emailIndex()
+	if err != nil {
+		return err
+	}
+
+	updates := make(map[string]interface{})
+	idFor := func(codedEmail string) string {
+		email := dbDecodeEmail(codedEmail)
+		if id, ok := index[email]; ok {
+			return id
+		}
+		id := dbNewID()
+		index[email] = id
+		updates["emails/"+codedEmail] = id
+		return id
+	}
+
+	// Keys with an @ are coded emails; IDs never have one
+	users := make(map[string]User)
+	err = dab.db.NewRef("/users").Get(dab.ctx, &users)
+	if err != nil {
+		return err
+	}
+	for key, user := range users {
+		if strings.Contains(key, "@") {
+			user.Email = dbDecodeEmail(key)
+			updates["users/"+idFor(key)] = user
+			updates["users/"+key] = nil
+		}
+	}
+
+	archive := make(map[string]ArchivedUser)
+	err = dab.db.NewRef("/archive").Get(dab.ctx, &archive)
+	if err != nil {
+		return err
+	}
+	for key, user := range archive {
+		if strings.Contains(key, "@") {
+			user.Email = dbDecodeEmail(key)
+			updates["archive/"+idFor(key)] = user
+			updates["archive/"+key] = nil
+		}
+	}
+
+	// Entries and certifications are moved as-is
+	for _, node := range []string{"entries", "certifications"} {
+		m := make(map[string]interface{})
+		err = dab.db.NewRef("/"+node).Get(dab.ctx, &m)
+		if err != nil {
+			return err
+		}
+		for key, value := range m {
+			if strings.Contains(key, "@") {
+				updates[node+"/"+idFor(key)] = value
+				updates[node+"/"+key] = nil
+			}
+		}
+	}
+
+	if len(updates) != 0 {
+		err = dab.db.NewRef("/").Update(dab.ctx, updates)
+		if err != nil {
+			return err
+		}
+	}
+	return dab.migratePhones()
+}
+
+// converts contact phone numbers of entries, including those in the trash, that are stored as integers to E.164.
+// This is recorded in /migrations, so that the entries are only read once.
+func (dab *Database) migratePhones() error {
+	migrated := time.Time{}
+	err := dab.db.NewRef("/migrations/phones").Get(dab.ctx, &migrated)
+	if err != nil {
+		return err
+	}
+	if !migrated.IsZero() {
+		return nil
+	}
+
+	updates := map[string]interface{}{"migrations/phones": time.Now()}
+	migrate := func(path string, entry map[string]interface{}) {
+		if n, ok := entry["contact_phone"].(float64); ok {
+			updates[path+"/contact_phone"] = LegacyPhone(uint64(n))
+		}
+	}
+
+	entries := make(map[string]map[string]map[string]interface{})
+	err = dab.db.NewRef("/entries").Get(dab.ctx, &entries)
+	if err != nil {
+		return err
+	}
+	for id, list := range entries {
+		for key, entry := range list {
+			migrate("entries/"+id+"/"+key, entry)
+		}
+	}
+
+	trash := make(map[string]map[string]struct {
+		Entry map[string]interface{} `json:"entry"`
+	})
+	err = dab.db.NewRef("/trash").Get(dab.ctx, &trash)
+	if err != nil {
+		return err
+	}
+	for id, list := range trash {
+		for key, trashed := range list {
+			migrate("trash/"+id+"/"+key+"/entry", trashed.Entry)
+		}
+	}
+	return dab.db.NewRef("/").Update(dab.ctx, updates)
+}
+
 // Method Get returns the entry if it does exist and and error otherwise
 func (dab *Database) Get(email string, key string) (*Entry, error) {
+	id := dab.userID(email)
+	if id == "" {
+		return nil, EntryNotFound
+	}
+
 	entry := new(Entry)
-	err := dab.db.NewRef("/entries").Child(dbCodeEmail(email)).Child(key).Get(dab.ctx, entry)
+	err := dab.db.NewRef("/entries").Child(id).Child(key).Get(dab.ctx, entry)
 	if err != nil {
 		return nil, err
 	}
@@ -66,34 +258,194 @@ func (dab *Database) Get(email string, key string) (*Entry, error) {
 
 // Method Add should be self-explanatory.
 func (dab *Database) Add(email string, entry *Entry) (string, error) {
-	ref, err := dab.db.NewRef("/entries").Child(dbCodeEmail(email)).Push(dab.ctx, entry)
-	return path.Base(ref.Path), err
+	id, err := dab.ensureUserID(email)
+	if err != nil {
+		return "", err
+	}
+	ref, err := dab.db.NewRef("/entries").Child(id).Push(dab.ctx, entry)
+	if err != nil {
+		return "", err
+	}
+	return path.Base(ref.Path), nil
 }
 
-// Method Set updates an entry.
-func (dab *Database) Set(email string, key string, entry *Entry) error {
-	ref := dab.db.NewRef("/entries").Child(dbCodeEmail(email)).Child(key)
-	return ref.Set(dab.ctx, entry)
+// Method Set updates an entry and increments its version. If check is set, it fails with EntryConflict unless
+// entry.Version is the version that is stored. Returns the entry as it was before.
+func (dab *Database) Set(email string, key string, entry *Entry, check bool) (*Entry, error) {
+	id := dab.userID(email)
+	if id == "" {
+		return nil, EntryNotFound
+	}
+
+	var old *Entry
+	ref := dab.db.NewRef("/entries").Child(id).Child(key)
+	err := ref.Transaction(dab.ctx, db.UpdateFn(func(node db.TransactionNode) (interface{}, error) {
+		old = new(Entry)
+		err := node.Unmarshal(old)
+		if err != nil {
+			return nil, err
+		}
+		if old.Name == "" {
+			return nil, EntryNotFound
+		}
+		if check && entry.Version != old.Version {
+			return nil, EntryConflict
+		}
+		entry.Version = old.Version + 1
+		return entry, nil
+	}))
+	return old, err
 }
 
-// Method Flag flags or unflags an entry.
+// Method Flag flags or unflags an entry. Its version changes, like with Set.
 func (dab *Database) Flag(email string, key string, flag bool) error {
-	ref := dab.db.NewRef("/entries").Child(dbCodeEmail(email)).Child(key)
-	return ref.Update(dab.ctx, map[string]interface{}{
-		"flagged": flag,
+	id := dab.userID(email)
+	if id == "" {
+		return EntryNotFound
+	}
+	ref := dab.db.NewRef("/entries").Child(id).Child(key)
+	return ref.Transaction(dab.ctx, db.UpdateFn(func(node db.TransactionNode) (interface{}, error) {
+		entry := new(Entry)
+		err := node.Unmarshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Name == "" {
+			return nil, EntryNotFound
+		}
+		entry.Flagged = flag
+		entry.Version++
+		return entry, nil
+	}))
+}
+
+// Method Trash moves an entry to the trash. Any request to delete it is removed.
+func (dab *Database) Trash(email string, key string, trashed TrashedEntry) error {
+	id := dab.userID(email)
+	if id == "" {
+		return EntryNotFound
+	}
+	return dab.db.NewRef("/").Update(dab.ctx, map[string]interface{}{
+		"entries/" + id + "/" + key:           nil,
+		"trash/" + id + "/" + key:             trashed,
+		"deletion_requests/" + id + "/" + key: nil,
 	})
 }
 
-// Method Remove removes an entry.
-func (dab *Database) Remove(email string, key string) error {
-	ref := dab.db.NewRef("/entries").Child(dbCodeEmail(email)).Child(key)
-	return ref.Delete(dab.ctx)
+// Method Trashed returns the entries in a student's trash, or everyone's if the email is empty, most recently
+// deleted first.
+func (dab *Database) Trashed(email string) ([]TrashedEntry, error) {
+	byID := make(map[string]map[string]TrashedEntry)
+	if email != "" {
+		id := dab.userID(email)
+		if id == "" {
+			return nil, nil
+		}
+		trash := make(map[string]TrashedEntry)
+		err := dab.db.NewRef("/trash").Child(id).OrderByKey().Get(dab.ctx, &trash)
+		if err != nil {
+			return nil, err
+		}
+		byID[id] = trash
+	} else {
+		err := dab.db.NewRef("/trash").OrderByKey().Get(dab.ctx, &byID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	emails, err := dab.emailsByID()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []TrashedEntry(nil)
+	for id, trash := range byID {
+		for key, trashed := range trash {
+			trashed.Email = emails[id]
+			trashed.Key = key
+			trashed.userID = id
+			out = append(out, trashed)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Deleted.After(out[j].Deleted)
+	})
+	return out, nil
+}
+
+// returns an entry in the trash.
+func (dab *Database) trashed(email string, key string) (string, TrashedEntry, error) {
+	trashed := TrashedEntry{}
+	id := dab.userID(email)
+	if id == "" {
+		return "", trashed, EntryNotFound
+	}
+	err := dab.db.NewRef("/trash").Child(id).Child(key).Get(dab.ctx, &trashed)
+	if err != nil {
+		return "", trashed, err
+	}
+	if trashed.Entry == nil || trashed.Entry.Name == "" {
+		return "", trashed, EntryNotFound
+	}
+	trashed.Email = email
+	trashed.Key = key
+	return id, trashed, nil
+}
+
+// Method Restore moves an entry out of the trash. Returns the entry as it was when it was deleted.
+func (dab *Database) Restore(email string, key string) (TrashedEntry, error) {
+	id, trashed, err := dab.trashed(email, key)
+	if err != nil {
+		return trashed, err
+	}
+	return trashed, dab.db.NewRef("/").Update(dab.ctx, map[string]interface{}{
+		"entries/" + id + "/" + key: trashed.Entry,
+		"trash/" + id + "/" + key:   nil,
+	})
+}
+
+// Method Purge permanently deletes an entry in the trash. Returns the entry as it was when it was deleted.
+func (dab *Database) Purge(email string, key string) (TrashedEntry, error) {
+	id, trashed, err := dab.trashed(email, key)
+	if err != nil {
+		return trashed, err
+	}
+	return trashed, dab.db.NewRef("/trash").Child(id).Child(key).Delete(dab.ctx)
+}
+
+// Method PurgeTrash permanently deletes entries that have been in the trash for longer than the retention period.
+// Returns the entries that were deleted.
+func (dab *Database) PurgeTrash(retention time.Duration) ([]TrashedEntry, error) {
+	trash, err := dab.Trashed("")
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	purged := []TrashedEntry(nil)
+	updates := make(map[string]interface{})
+	for _, trashed := range trash {
+		if now.After(trashed.PurgeAt(retention)) {
+			updates[trashed.userID+"/"+trashed.Key] = nil
+			purged = append(purged, trashed)
+		}
+	}
+	if len(updates) == 0 {
+		return nil, nil
+	}
+	return purged, dab.db.NewRef("/trash").Update(dab.ctx, updates)
 }
 
 // Method List returns a list of a person's entries.
 func (dab *Database) List(email string) (EntryList, error) {
 	list := make(EntryList)
-	query := dab.db.NewRef("/entries").Child(dbCodeEmail(email)).OrderByKey()
+	id := dab.userID(email)
+	if id == "" {
+		return list, nil
+	}
+
+	query := dab.db.NewRef("/entries").Child(id).OrderByKey()
 	err := query.Get(dab.ctx, &list)
 	if err != nil {
 		return nil, err
@@ -101,89 +453,1205 @@ func (dab *Database) List(email string) (EntryList, error) {
 	return list, nil
 }
 
+// Method ListAll returns everyone's entries, keyed by email.
 func (dab *Database) ListAll() (map[string]EntryList, error) {
-	out := make(map[string]EntryList)
+	lists := make(map[string]EntryList)
 	query := dab.db.NewRef("/entries").OrderByKey()
-	err := query.Get(dab.ctx, &out)
+	err := query.Get(dab.ctx, &lists)
 	if err != nil {
 		return nil, err
 	}
 
-	for codedEmail, list := range out {
-		out[dbDecodeEmail(codedEmail)] = list
-		delete(out, codedEmail)
+	emails, err := dab.emailsByID()
+	if err != nil {
+		return nil, err
 	}
 
+	out := make(map[string]EntryList, len(lists))
+	for id, list := range lists {
+		if email, ok := emails[id]; ok {
+			out[email] = list
+		}
+	}
 	return out, nil
 }
 
-// Method User returns a user.
+// Method User returns a user. Archived users are returned if they are no longer on the roster.
 func (dab *Database) User(email string) User {
-	user := User{Name: email}
-	dab.db.NewRef("/users").Child(dbCodeEmail(email)).Get(dab.ctx, &user)
+	user, ok := dab.UserExists(email)
+	if !ok && user.ID != "" {
+		archived := ArchivedUser{}
+		dab.db.NewRef("/archive").Child(user.ID).Get(dab.ctx, &archived)
+		archived.User.ID = user.ID
+		user = archived.User
+	}
+	if user.Name == "" {
+		user.Name = email
+	}
 	user.Email = email
 	return user
 }
 
+// Method UserExists returns a user and whether they are on the roster (not archived).
+func (dab *Database) UserExists(email string) (User, bool) {
+	user := User{}
+	id := dab.userID(email)
+	if id != "" {
+		dab.db.NewRef("/users").Child(id).Get(dab.ctx, &user)
+	}
+	user.ID = id
+	user.Email = email
+	return user, user.Name != ""
+}
+
+// Method Users returns every user on the roster, keyed by email.
 func (dab *Database) Users() (map[string]User, error) {
-	m := make(map[string]User)
+	byID := make(map[string]User)
 	query := dab.db.NewRef("/users").OrderByKey()
-	err := query.Get(dab.ctx, &m)
+	err := query.Get(dab.ctx, &byID)
 
-	for email, user := range m {
-		delete(m, email)
-		user.Email = dbDecodeEmail(email)
+	m := make(map[string]User, len(byID))
+	for id, user := range byID {
+		user.ID = id
 		m[user.Email] = user
 	}
 
 	return m, err
 }
 
-// Deletes all non-Admin users and adds all users specified in here.
-func (dab *Database) SetStudents(users []User) error {
-	usersRef := dab.db.NewRef("/users")
-	return usersRef.Transaction(dab.ctx, db.UpdateFn(func(node db.TransactionNode) (interface{}, error) {
-		oldUsers := make(map[string]User, 0)
+var LastAdmin = errors.New("there must be at least one active admin")
+
+// Method UpdateStaff adds a user or changes their roles or whether they are disabled. fn is called with the
+// current user, or a new user with only an email. Fails with LastAdmin if no active admins would be left.
+func (dab *Database) UpdateStaff(email string, fn func(user *User)) error {
+	id, err := dab.ensureUserID(email)
+	if err != nil {
+		return err
+	}
+
+	return dab.db.NewRef("/users").Transaction(dab.ctx, db.UpdateFn(func(node db.TransactionNode) (interface{}, error) {
+		users := make(map[string]User)
+		err := node.Unmarshal(&users)
+		if err != nil {
+			return nil, err
+		}
+
+		user, ok := users[id]
+		if !ok {
+			user = User{Email: email}
+		}
+		fn(&user)
+		users[id] = user
+
+		for _, user := range users {
+			if user.Admin && !user.Disabled {
+				return users, nil
+			}
+		}
+		return nil, LastAdmin
+	}))
+}
+
+// Method SignedIn records that a user signed in.
+func (dab *Database) SignedIn(email string) error {
+	id, err := dab.ensureUserID(email)
+	if err != nil {
+		return err
+	}
+	return dab.db.NewRef("/signins").Child(id).Set(dab.ctx, time.Now())
+}
+
+// Method SignIns returns when each user last signed in, keyed by email.
+func (dab *Database) SignIns() (map[string]time.Time, error) {
+	byID := make(map[string]time.Time)
+	err := dab.db.NewRef("/signins").OrderByKey().Get(dab.ctx, &byID)
+	if err != nil {
+		return nil, err
+	}
+
+	emails, err := dab.emailsByID()
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]time.Time, len(byID))
+	for id, t := range byID {
+		if email, ok := emails[id]; ok {
+			m[email] = t
+		}
+	}
+	return m, nil
+}
+
+var RosterStale = errors.New("the roster changed since it was previewed")
+
+// Archives all non-Admin users that are not specified in here and adds all users specified in here. If version is
+// not empty, nothing is changed and RosterStale is returned unless the roster is still at that version.
+func (dab *Database) SetStudents(users []User, version string) error {
+	return dab.updateStudents(users, true, version)
+}
+
+// Method UpsertStudents adds or updates the users specified in here, leaving all others alone. version is checked
+// like in SetStudents.
+func (dab *Database) UpsertStudents(users []User, version string) error {
+	return dab.updateStudents(users, false, version)
+}
+
+// returns a version of the users, keyed by ID, that changes whenever any of them changes.
+func rosterVersion(users map[string]User) string {
+	data, _ := json.Marshal(users)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Method RosterVersion returns the current version of the roster.
+func (dab *Database) RosterVersion() (string, error) {
+	users := make(map[string]User)
+	err := dab.db.NewRef("/users").Get(dab.ctx, &users)
+	if err != nil {
+		return "", err
+	}
+	return rosterVersion(users), nil
+}
+
+// adds or updates users. If replace is true, all other non-Admin users are archived.
+//
+// Users are matched to existing and archived users by student ID if they have one, and by email otherwise.
+// A user whose email changed keeps their ID. The users are changed in a transaction, so that changes made to them
+// in the meantime are never overwritten, and the archive and the email index are updated to match afterwards.
+func (dab *Database) updateStudents(users []User, replace bool, version string) error {
+	index, err := dab.emailIndex()
+	if err != nil {
+		return err
+	}
+	archived := make(map[string]ArchivedUser)
+	err = dab.db.NewRef("/archive").Get(dab.ctx, &archived)
+	if err != nil {
+		return err
+	}
+
+	var updates map[string]interface{}
+	err = dab.db.NewRef("/users").Transaction(dab.ctx, db.UpdateFn(func(node db.TransactionNode) (interface{}, error) {
+		oldUsers := make(map[string]User)
 		err := node.Unmarshal(&oldUsers)
 		if err != nil {
 			return nil, err
 		}
+		if version != "" && rosterVersion(oldUsers) != version {
+			return nil, RosterStale
+		}
 
-		for codedEmail, oldUser := range oldUsers {
-			if !oldUser.Admin {
-				delete(oldUsers, codedEmail)
+		byStudentID := make(map[string]string)
+		byEmail := make(map[string]string)
+		previous := make(map[string]User)
+		for id, user := range archived {
+			previous[id] = user.User
+		}
+		for id, user := range oldUsers {
+			previous[id] = user
+		}
+		for id, user := range previous {
+			if user.StudentID != "" {
+				byStudentID[user.StudentID] = id
 			}
+			byEmail[user.Email] = id
 		}
 
+		// The transaction may run more than once, so the other updates are started over each time
+		updates = make(map[string]interface{})
+		newUsers := make(map[string]User, len(oldUsers))
+		for id, user := range oldUsers {
+			newUsers[id] = user
+		}
+		updated := make(map[string]bool)
 		for _, user := range users {
 			if len(user.Email) == 0 {
 				continue
 			}
 
-			oldUser := oldUsers[dbCodeEmail(user.Email)]
-			user.Admin = oldUser.Admin
-			oldUsers[dbCodeEmail(user.Email)] = user
+			id := ""
+			if user.StudentID != "" {
+				id = byStudentID[user.StudentID]
+			}
+			if id == "" {
+				id = byEmail[user.Email]
+			}
+			if id == "" {
+				id = index[user.Email]
+			}
+			if id == "" {
+				id = dbNewID()
+			}
+
+			oldUser := previous[id]
+			if oldUser.Email != "" && oldUser.Email != user.Email {
+				updates["emails/"+dbCodeEmail(oldUser.Email)] = nil
+			}
+			updates["emails/"+dbCodeEmail(user.Email)] = id
+
+			user.Admin = oldUsers[id].Admin
+			user.Staff = oldUsers[id].Staff
+			user.Disabled = oldUsers[id].Disabled
+			newUsers[id] = user
+			updated[id] = true
+			// Students who are back on the roster are no longer archived
+			if _, ok := archived[id]; ok {
+				updates["archive/"+id] = nil
+			}
 		}
 
-		return oldUsers, nil
+		if replace {
+			now := time.Now()
+			for id, oldUser := range oldUsers {
+				if !updated[id] && !oldUser.Admin && !oldUser.Staff {
+					updates["archive/"+id] = ArchiveUser(oldUser, now)
+					delete(newUsers, id)
+				}
+			}
+		}
+
+		return newUsers, nil
 	}))
+	if err != nil || len(updates) == 0 {
+		return err
+	}
+	return dab.db.NewRef("/").Update(dab.ctx, updates)
 }
 
-func (dab *Database) Flagged() (map[[2]string]*Entry, error) {
-	entries := make(map[string]EntryList)
-	err := dab.db.NewRef("/entries").OrderByKey().Get(dab.ctx, &entries)
-	if err != nil {
-		return nil, err
+// Method DeactivateStudent moves a student from the roster to the archive. Admins cannot be deactivated.
+func (dab *Database) DeactivateStudent(email string) error {
+	id := dab.userID(email)
+	if id == "" {
+		return nil
 	}
 
-	m := make(map[[2]string]*Entry)
-	for email, list := range entries {
-		for key, entry := range list {
-			if entry.Flagged {
-				m[[2]string{dbDecodeEmail(email), key}] = entry
-			}
+	ref := dab.db.NewRef("/users").Child(id)
+	var archived *ArchivedUser
+	err := ref.Transaction(dab.ctx, db.UpdateFn(func(node db.TransactionNode) (interface{}, error) {
+		user := User{}
+		err := node.Unmarshal(&user)
+		if err != nil {
+			return nil, err
+		}
+
+		archived = nil
+		if user.Name == "" {
+			return nil, nil
 		}
+		if user.Admin || user.Staff {
+			return nil, fmt.Errorf("staff cannot be deactivated from the roster")
+		}
+
+		user.Email = email
+		a := ArchiveUser(user, time.Now())
+		archived = &a
+		return nil, nil
+	}))
+	if err != nil || archived == nil {
+		return err
 	}
 
-	return m, nil
+	return dab.db.NewRef("/archive").Child(id).Set(dab.ctx, archived)
+}
+
+// Method ChangeEmail changes the email of a user or archived user. Their entries and history are kept.
+func (dab *Database) ChangeEmail(oldEmail string, newEmail string) error {
+	id := dab.userID(oldEmail)
+	if id == "" {
+		return fmt.Errorf("%v not found", oldEmail)
+	}
+	if dab.userID(newEmail) != "" {
+		return fmt.Errorf("%v already has an account; merge the accounts instead", newEmail)
+	}
+
+	updates := map[string]interface{}{
+		"emails/" + dbCodeEmail(oldEmail): nil,
+		"emails/" + dbCodeEmail(newEmail): id,
+	}
+	archived := ArchivedUser{}
+	dab.db.NewRef("/archive").Child(id).Get(dab.ctx, &archived)
+	if _, ok := dab.UserExists(oldEmail); ok {
+		updates["users/"+id+"/email"] = newEmail
+	} else if archived.Name != "" {
+		updates["archive/"+id+"/email"] = newEmail
+	}
+	return dab.db.NewRef("/").Update(dab.ctx, updates)
+}
+
+// Method MergeUsers moves all of a user's entries, along with their comments, trash, and deletion requests, to another
+// user, then deletes the first user.
+func (dab *Database) MergeUsers(fromEmail string, intoEmail string) error {
+	from := dab.userID(fromEmail)
+	into := dab.userID(intoEmail)
+	if from == "" {
+		return fmt.Errorf("%v not found", fromEmail)
+	}
+	if into == "" {
+		return fmt.Errorf("%v not found", intoEmail)
+	}
+	if from == into {
+		return fmt.Errorf("cannot merge an account into itself")
+	}
+
+	// Entry and notification keys are unique across users, so everything that is keyed by them can be moved as-is
+	updates := make(map[string]interface{})
+	for _, node := range []string{"entries", "comments", "trash", "deletion_requests", "notifications"} {
+		byKey := make(map[string]interface{})
+		err := dab.db.NewRef("/"+node).Child(from).Get(dab.ctx, &byKey)
+		if err != nil {
+			return err
+		}
+		for key, value := range byKey {
+			updates[node+"/"+into+"/"+key] = value
+		}
+		updates[node+"/"+from] = nil
+	}
+	for _, node := range []string{"users", "archive", "certifications", "signins", "preferences"} {
+		updates[node+"/"+from] = nil
+	}
+
+	// Tokens refer to the user
+	for node, field := range userFields {
+		keys, err := dab.keysOfUser(node, field, from)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			updates[node+"/"+key+"/"+field] = into
+		}
+	}
+	updates["emails/"+dbCodeEmail(fromEmail)] = nil
+	return dab.db.NewRef("/").Update(dab.ctx, updates)
+}
+
+// Nodes whose children refer to a user by ID, and the field that has the ID. Each must be indexed on the field;
+// see database.rules.json.
+var userFields = map[string]string{
+	"tokens": "user",
+}
+
+// returns the keys of the children of a node whose field is a user's ID.
+func (dab *Database) keysOfUser(node string, field string, id string) ([]string, error) {
+	m := make(map[string]interface{})
+	err := dab.db.NewRef("/"+node).OrderByChild(field).EqualTo(id).Get(dab.ctx, &m)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Method Archive returns every archived user, keyed by email.
+func (dab *Database) Archive() (map[string]ArchivedUser, error) {
+	byID := make(map[string]ArchivedUser)
+	err := dab.db.NewRef("/archive").OrderByKey().Get(dab.ctx, &byID)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]ArchivedUser, len(byID))
+	for id, user := range byID {
+		user.ID = id
+		m[user.Email] = user
+	}
+	return m, nil
+}
+
+// Method PurgeArchive permanently deletes archived users who have been archived for longer than the retention
+// period, along with their entries, tokens, and everything else about them. Returns the number of users deleted.
+func (dab *Database) PurgeArchive(retention time.Duration) (int, error) {
+	archive, err := dab.Archive()
+	if err != nil {
+		return 0, err
+	}
+	index, err := dab.emailIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	count := 0
+	updates := make(map[string]interface{})
+	for _, user := range archive {
+		if !user.Expired(retention, now) {
+			continue
+		}
+		for _, node := range []string{"archive", "entries", "comments", "trash", "deletion_requests", "certifications", "signins", "preferences", "notifications"} {
+			updates[node+"/"+user.ID] = nil
+		}
+		for node, field := range userFields {
+			keys, err := dab.keysOfUser(node, field, user.ID)
+			if err != nil {
+				return 0, err
+			}
+			for _, key := range keys {
+				updates[node+"/"+key] = nil
+			}
+		}
+		for email, id := range index {
+			if id == user.ID {
+				updates["emails/"+dbCodeEmail(email)] = nil
+			}
+		}
+		count++
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+	return count, dab.db.NewRef("/").Update(dab.ctx, updates)
+}
+
+func (dab *Database) Flagged() (map[[2]string]*Entry, error) {
+	entries, err := dab.ListAll()
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[[2]string]*Entry)
+	for email, list := range entries {
+		for key, entry := range list {
+			if entry.Flagged {
+				m[[2]string{email, key}] = entry
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// Method Certifications returns every student's certification, keyed by email.
+func (dab *Database) Certifications() (map[string]Certification, error) {
+	byID := make(map[string]Certification)
+	err := dab.db.NewRef("/certifications").OrderByKey().Get(dab.ctx, &byID)
+	if err != nil {
+		return nil, err
+	}
+
+	emails, err := dab.emailsByID()
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]Certification, len(byID))
+	for id, cert := range byID {
+		if email, ok := emails[id]; ok {
+			m[email] = cert
+		}
+	}
+	return m, nil
+}
+
+// Method Certify sets a student's certification. A certification with status CERT_PENDING removes it.
+func (dab *Database) Certify(email string, cert Certification) error {
+	id := dab.userID(email)
+	if id == "" {
+		return fmt.Errorf("%v not found", email)
+	}
+
+	ref := dab.db.NewRef("/certifications").Child(id)
+	if cert.Status == CERT_PENDING {
+		return ref.Delete(dab.ctx)
+	}
+	return ref.Set(dab.ctx, cert)
+}
+
+// Method AwardTiers returns the configured award tiers, or DefaultAwardTiers if none are configured.
+func (dab *Database) AwardTiers() ([]AwardTier, error) {
+	tiers := []AwardTier(nil)
+	err := dab.db.NewRef("/awards").Get(dab.ctx, &tiers)
+	if err != nil {
+		return nil, err
+	}
+	if len(tiers) == 0 {
+		return DefaultAwardTiers, nil
+	}
+	return tiers, nil
+}
+
+// Method SetAwardTiers replaces the award tiers.
+func (dab *Database) SetAwardTiers(tiers []AwardTier) error {
+	return dab.db.NewRef("/awards").Set(dab.ctx, tiers)
+}
+
+// Method Advisors returns every advisor, keyed by email.
+func (dab *Database) Advisors() (map[string]Advisor, error) {
+	m := make(map[string]Advisor)
+	err := dab.db.NewRef("/advisors").OrderByKey().Get(dab.ctx, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	for codedEmail, advisor := range m {
+		delete(m, codedEmail)
+		advisor.Email = dbDecodeEmail(codedEmail)
+		m[advisor.Email] = advisor
+	}
+	return m, nil
+}
+
+// Method SetAdvisors replaces all advisors.
+func (dab *Database) SetAdvisors(advisors []Advisor) error {
+	m := make(map[string]Advisor, len(advisors))
+	for _, advisor := range advisors {
+		m[dbCodeEmail(advisor.Email)] = advisor
+	}
+	return dab.db.NewRef("/advisors").Set(dab.ctx, m)
+}
+
+// Method APITokens returns a user's API tokens.
+func (dab *Database) APITokens(email string) ([]APIToken, error) {
+	id := dab.userID(email)
+	if id == "" {
+		return nil, nil
+	}
+
+	m := make(map[string]APIToken)
+	err := dab.db.NewRef("/tokens").OrderByChild("user").EqualTo(id).Get(dab.ctx, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]APIToken, 0, len(m))
+	for hash, token := range m {
+		token.ID = hash
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// Method AddAPIToken stores a user's API token.
+func (dab *Database) AddAPIToken(email string, token *APIToken) error {
+	id, err := dab.ensureUserID(email)
+	if err != nil {
+		return err
+	}
+	token.User = id
+	return dab.db.NewRef("/tokens").Child(token.ID).Set(dab.ctx, token)
+}
+
+// Method RevokeAPIToken deletes one of a user's API tokens.
+func (dab *Database) RevokeAPIToken(email string, hash string) error {
+	token := APIToken{}
+	ref := dab.db.NewRef("/tokens").Child(hash)
+	err := ref.Get(dab.ctx, &token)
+	if err != nil {
+		return err
+	}
+	if token.User == "" || token.User != dab.userID(email) {
+		return TokenInvalid
+	}
+	return ref.Delete(dab.ctx)
+}
+
+// Method UserFromAPIToken returns the user that an API token belongs to, and records that it was used.
+// Fails with TokenInvalid if the token doesn't exist or has expired, or if the user is no longer on the roster.
+func (dab *Database) UserFromAPIToken(secret string) (User, *APIToken, error) {
+	if !strings.HasPrefix(secret, TOKEN_PREFIX) {
+		return User{}, nil, TokenInvalid
+	}
+
+	token := &APIToken{}
+	ref := dab.db.NewRef("/tokens").Child(tokenHash(secret))
+	err := ref.Get(dab.ctx, token)
+	if err != nil {
+		return User{}, nil, err
+	}
+	now := time.Now()
+	if token.User == "" || token.Expired(now) {
+		return User{}, nil, TokenInvalid
+	}
+	token.ID = tokenHash(secret)
+
+	user := User{}
+	err = dab.db.NewRef("/users").Child(token.User).Get(dab.ctx, &user)
+	if err != nil {
+		return User{}, nil, err
+	}
+	if user.Email == "" || user.Disabled {
+		return User{}, nil, TokenInvalid
+	}
+	user.ID = token.User
+	if user.Name == "" {
+		user.Name = user.Email
+	}
+
+	// Scripts may use a token many times a minute
+	if now.Sub(token.LastUsed) > time.Minute {
+		token.LastUsed = now
+		if err := ref.Child("last_used").Set(dab.ctx, now); err != nil {
+			return User{}, nil, err
+		}
+	}
+	return user, token, nil
+}
+
+// Method Webhooks returns every webhook endpoint, keyed by ID.
+func (dab *Database) Webhooks() (map[string]Webhook, error) {
+	m := make(map[string]Webhook)
+	err := dab.db.NewRef("/webhooks").OrderByKey().Get(dab.ctx, &m)
+	if err != nil {
+		return nil, err
+	}
+	for id, webhook := range m {
+		webhook.ID = id
+		m[id] = webhook
+	}
+	return m, nil
+}
+
+// Method SetWebhook adds or replaces a webhook endpoint. An endpoint without an ID is given one.
+func (dab *Database) SetWebhook(webhook *Webhook) error {
+	if webhook.ID == "" {
+		webhook.ID = dbNewID()
+	}
+	return dab.db.NewRef("/webhooks").Child(webhook.ID).Set(dab.ctx, webhook)
+}
+
+// Method RemoveWebhook removes a webhook endpoint along with its deliveries.
+func (dab *Database) RemoveWebhook(id string) error {
+	deliveries := make(map[string]interface{})
+	err := dab.db.NewRef("/deliveries").OrderByChild("webhook").EqualTo(id).Get(dab.ctx, &deliveries)
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{"webhooks/" + id: nil}
+	for key := range deliveries {
+		updates["deliveries/"+key] = nil
+	}
+	return dab.db.NewRef("/").Update(dab.ctx, updates)
+}
+
+// Method Deliveries returns every webhook delivery, newest first.
+func (dab *Database) Deliveries() ([]Delivery, error) {
+	m := make(map[string]Delivery)
+	err := dab.db.NewRef("/deliveries").OrderByKey().Get(dab.ctx, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]Delivery, 0, len(m))
+	for id, delivery := range m {
+		delivery.ID = id
+		deliveries = append(deliveries, delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Created.After(deliveries[j].Created)
+	})
+	return deliveries, nil
+}
+
+// Method PendingDeliveries returns the webhook deliveries that are still pending, oldest first.
+func (dab *Database) PendingDeliveries() ([]Delivery, error) {
+	m := make(map[string]Delivery)
+	err := dab.db.NewRef("/deliveries").OrderByChild("status").EqualTo(DELIVERY_PENDING).Get(dab.ctx, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]Delivery, 0, len(m))
+	for id, delivery := range m {
+		delivery.ID = id
+		deliveries = append(deliveries, delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Created.Before(deliveries[j].Created)
+	})
+	return deliveries, nil
+}
+
+// Method AddDeliveries adds webhook deliveries to the outbox.
+func (dab *Database) AddDeliveries(deliveries []Delivery) error {
+	updates := make(map[string]interface{}, len(deliveries))
+	for _, delivery := range deliveries {
+		updates[delivery.ID] = delivery
+	}
+	return dab.db.NewRef("/deliveries").Update(dab.ctx, updates)
+}
+
+// Method RemoveDeliveries deletes webhook deliveries.
+func (dab *Database) RemoveDeliveries(ids []string) error {
+	updates := make(map[string]interface{}, len(ids))
+	for _, id := range ids {
+		updates[id] = nil
+	}
+	return dab.db.NewRef("/deliveries").Update(dab.ctx, updates)
+}
+
+// Method SetDelivery updates a webhook delivery.
+func (dab *Database) SetDelivery(delivery Delivery) error {
+	return dab.db.NewRef("/deliveries").Child(delivery.ID).Set(dab.ctx, delivery)
+}
+
+// Method PurgeDeliveries deletes deliveries that were created longer than the retention period ago and are no
+// longer pending. Returns the number of deliveries deleted.
+func (dab *Database) PurgeDeliveries(retention time.Duration) (int, error) {
+	deliveries, err := dab.Deliveries()
+	if err != nil {
+		return 0, err
+	}
+
+	updates := make(map[string]interface{})
+	for _, delivery := range deliveries {
+		if delivery.Status != DELIVERY_PENDING && time.Since(delivery.Created) > retention {
+			updates[delivery.ID] = nil
+		}
+	}
+	if len(updates) == 0 {
+		return 0, nil
+	}
+	return len(updates), dab.db.NewRef("/deliveries").Update(dab.ctx, updates)
+}
+
+// Method AddRosterPreview stores a roster preview and returns its ID.
+func (dab *Database) AddRosterPreview(preview *RosterPreview) (string, error) {
+	id := randomToken()
+	return id, dab.db.NewRef("/previews").Child(id).Set(dab.ctx, preview)
+}
+
+// Method RosterPreview returns a roster preview, or nil if there is no preview with that ID.
+func (dab *Database) RosterPreview(id string) (*RosterPreview, error) {
+	if id == "" {
+		return nil, nil
+	}
+	var preview *RosterPreview
+	err := dab.db.NewRef("/previews").Child(id).Get(dab.ctx, &preview)
+	return preview, err
+}
+
+// Method RemoveRosterPreview deletes a roster preview once it has been applied.
+func (dab *Database) RemoveRosterPreview(id string) error {
+	if id == "" {
+		return nil
+	}
+	return dab.db.NewRef("/previews").Child(id).Delete(dab.ctx)
+}
+
+// Method PurgeRosterPreviews deletes the roster previews that have expired at a given instant. Returns the number of
+// previews deleted.
+func (dab *Database) PurgeRosterPreviews(t time.Time) (int, error) {
+	previews := make(map[string]*RosterPreview)
+	err := dab.db.NewRef("/previews").Get(dab.ctx, &previews)
+	if err != nil {
+		return 0, err
+	}
+
+	updates := make(map[string]interface{})
+	for id, preview := range previews {
+		if preview.Expired(t) {
+			updates[id] = nil
+		}
+	}
+	if len(updates) == 0 {
+		return 0, nil
+	}
+	return len(updates), dab.db.NewRef("/previews").Update(dab.ctx, updates)
+}
+
+// Method Outbox returns the messages waiting to be emailed, oldest first.
+func (dab *Database) Outbox() ([]OutgoingMail, error) {
+	m := make(map[string]OutgoingMail)
+	err := dab.db.NewRef("/mail").OrderByKey().Get(dab.ctx, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	outbox := make([]OutgoingMail, 0, len(m))
+	for id, mail := range m {
+		mail.ID = id
+		outbox = append(outbox, mail)
+	}
+	sort.Slice(outbox, func(i, j int) bool {
+		return outbox[i].Created.Before(outbox[j].Created)
+	})
+	return outbox, nil
+}
+
+// Method AddMail adds a message to the outbox.
+func (dab *Database) AddMail(mail OutgoingMail) error {
+	return dab.db.NewRef("/mail").Child(mail.ID).Set(dab.ctx, mail)
+}
+
+// Method SetMail updates a message in the outbox.
+func (dab *Database) SetMail(mail OutgoingMail) error {
+	return dab.db.NewRef("/mail").Child(mail.ID).Set(dab.ctx, mail)
+}
+
+// Method RemoveMail removes a message from the outbox once it has been sent or given up on.
+func (dab *Database) RemoveMail(id string) error {
+	return dab.db.NewRef("/mail").Child(id).Delete(dab.ctx)
+}
+
+// Method Preferences returns a user's preferences.
+func (dab *Database) Preferences(email string) (Preferences, error) {
+	prefs := Preferences{}
+	id := dab.userID(email)
+	if id == "" {
+		return prefs, nil
+	}
+	err := dab.db.NewRef("/preferences").Child(id).Get(dab.ctx, &prefs)
+	return prefs, err
+}
+
+// Method SetPreferences replaces a user's preferences.
+func (dab *Database) SetPreferences(email string, prefs Preferences) error {
+	id, err := dab.ensureUserID(email)
+	if err != nil {
+		return err
+	}
+	return dab.db.NewRef("/preferences").Child(id).Set(dab.ctx, prefs)
+}
+
+// Method MarkNotice records that a one-time notice was sent. Returns false if it was already sent.
+func (dab *Database) MarkNotice(name string) (bool, error) {
+	first := false
+	err := dab.db.NewRef("/notices").Child(name).Transaction(dab.ctx, db.UpdateFn(func(node db.TransactionNode) (interface{}, error) {
+		sent := time.Time{}
+		err := node.Unmarshal(&sent)
+		if err != nil {
+			return nil, err
+		}
+		first = sent.IsZero()
+		if !first {
+			return sent, nil
+		}
+		return time.Now(), nil
+	}))
+	return first, err
+}
+
+// Method DigestLog returns what happened since the last digest.
+func (dab *Database) DigestLog() (DigestLog, error) {
+	digestLog := DigestLog{}
+	err := dab.db.NewRef("/digest").Get(dab.ctx, &digestLog)
+	return digestLog, err
+}
+
+// Method LogDigestFlag records that an entry was flagged.
+func (dab *Database) LogDigestFlag(flag DigestFlag) error {
+	_, err := dab.db.NewRef("/digest/flagged").Push(dab.ctx, flag)
+	return err
+}
+
+// Method LogDigestRoster records that the roster changed.
+func (dab *Database) LogDigestRoster(event RosterEvent) error {
+	_, err := dab.db.NewRef("/digest/roster").Push(dab.ctx, event)
+	return err
+}
+
+// Method ClearDigestLog removes what was sent in a digest from the log, and records when it was sent and the status
+// of each student at the time. Anything logged after the digest was built is kept for the next one.
+func (dab *Database) ClearDigestLog(sent DigestLog, now time.Time, progress map[string]string) error {
+	updates := map[string]interface{}{
+		"last":     now,
+		"progress": progress,
+	}
+	for key := range sent.Flagged {
+		updates["flagged/"+key] = nil
+	}
+	for key := range sent.Roster {
+		updates["roster/"+key] = nil
+	}
+	return dab.db.NewRef("/digest").Update(dab.ctx, updates)
+}
+
+// Method Campaigns returns every reminder campaign, newest first.
+func (dab *Database) Campaigns() ([]Campaign, error) {
+	m := make(map[string]Campaign)
+	err := dab.db.NewRef("/campaigns").OrderByKey().Get(dab.ctx, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	campaigns := make([]Campaign, 0, len(m))
+	for id, c := range m {
+		c.ID = id
+		campaigns = append(campaigns, c)
+	}
+	sort.Slice(campaigns, func(i, j int) bool {
+		return campaigns[i].Created.After(campaigns[j].Created)
+	})
+	return campaigns, nil
+}
+
+// Method SetCampaign adds or replaces a reminder campaign. A campaign without an ID is given one.
+func (dab *Database) SetCampaign(c *Campaign) error {
+	if c.ID == "" {
+		c.ID = dbNewID()
+	}
+	return dab.db.NewRef("/campaigns").Child(c.ID).Set(dab.ctx, c)
+}
+
+// Method SetCampaignRecipient replaces the i-th recipient of a reminder campaign.
+func (dab *Database) SetCampaignRecipient(id string, i int, r CampaignRecipient) error {
+	return dab.db.NewRef("/campaigns").Child(id).Child("recipients").Child(fmt.Sprint(i)).Set(dab.ctx, r)
+}
+
+// Method SetCampaignStatus changes the status of a campaign if it has a given status. Returns whether it was changed.
+func (dab *Database) SetCampaignStatus(id string, from string, to string) (bool, error) {
+	changed := false
+	err := dab.db.NewRef("/campaigns").Child(id).Child("status").Transaction(dab.ctx, db.UpdateFn(func(node db.TransactionNode) (interface{}, error) {
+		status := ""
+		err := node.Unmarshal(&status)
+		if err != nil {
+			return nil, err
+		}
+		changed = status == from
+		if !changed {
+			return status, nil
+		}
+		return to, nil
+	}))
+	return changed, err
+}
+
+// Method Notifications returns a user's in-app notifications, newest first.
+func (dab *Database) Notifications(email string) ([]Notification, error) {
+	id := dab.userID(email)
+	if id == "" {
+		return nil, nil
+	}
+
+	m := make(map[string]Notification)
+	err := dab.db.NewRef("/notifications").Child(id).OrderByKey().Get(dab.ctx, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := make([]Notification, 0, len(m))
+	for key, n := range m {
+		n.ID = key
+		notifications = append(notifications, n)
+	}
+	sort.Slice(notifications, func(i, j int) bool {
+		return notifications[i].Created.After(notifications[j].Created)
+	})
+	return notifications, nil
+}
+
+// Method AddNotification adds an in-app notification for a user.
+func (dab *Database) AddNotification(email string, n *Notification) error {
+	id, err := dab.ensureUserID(email)
+	if err != nil {
+		return err
+	}
+	n.ID = dbNewID()
+	return dab.db.NewRef("/notifications").Child(id).Child(n.ID).Set(dab.ctx, n)
+}
+
+// Method MarkNotificationsRead marks some of a user's notifications as read. If ids is nil, every notification is
+// marked as read. IDs that don't exist are ignored.
+func (dab *Database) MarkNotificationsRead(email string, ids []string) error {
+	notifications, err := dab.Notifications(email)
+	if err != nil || len(notifications) == 0 {
+		return err
+	}
+
+	marked := make(map[string]bool, len(ids))
+	for _, key := range ids {
+		marked[key] = true
+	}
+	updates := make(map[string]interface{})
+	for _, n := range UnreadNotifications(notifications) {
+		if ids == nil || marked[n.ID] {
+			updates[n.ID+"/read"] = true
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	return dab.db.NewRef("/notifications").Child(dab.userID(email)).Update(dab.ctx, updates)
+}
+
+// Method PurgeNotifications deletes read notifications that were created longer than the retention period ago.
+// Returns the number of notifications deleted.
+func (dab *Database) PurgeNotifications(retention time.Duration) (int, error) {
+	m := make(map[string]map[string]Notification)
+	err := dab.db.NewRef("/notifications").OrderByKey().Get(dab.ctx, &m)
+	if err != nil {
+		return 0, err
+	}
+
+	updates := make(map[string]interface{})
+	for id, notifications := range m {
+		for key, n := range notifications {
+			if n.Read && time.Since(n.Created) > retention {
+				updates[id+"/"+key] = nil
+			}
+		}
+	}
+	if len(updates) == 0 {
+		return 0, nil
+	}
+	return len(updates), dab.db.NewRef("/notifications").Update(dab.ctx, updates)
+}
+
+// Method Comments returns the comments on an entry, oldest first. Comments are kept after the entry is deleted.
+func (dab *Database) Comments(email string, key string) ([]Comment, error) {
+	id := dab.userID(email)
+	if id == "" {
+		return nil, nil
+	}
+
+	m := make(map[string]Comment)
+	err := dab.db.NewRef("/comments").Child(id).Child(key).OrderByKey().Get(dab.ctx, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	comments := make([]Comment, 0, len(m))
+	for cid, c := range m {
+		c.ID = cid
+		comments = append(comments, c)
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		return comments[i].Created.Before(comments[j].Created)
+	})
+	return comments, nil
+}
+
+// Method AddComment adds a comment to an entry.
+func (dab *Database) AddComment(email string, key string, c *Comment) error {
+	id := dab.userID(email)
+	if id == "" {
+		return EntryNotFound
+	}
+	c.ID = dbNewID()
+	return dab.db.NewRef("/comments").Child(id).Child(key).Child(c.ID).Set(dab.ctx, c)
+}
+
+// Method AddAuditRecords adds records to the audit log. Records are never changed or deleted. The IDs of the students
+// are looked up in the email index, which is only read once for a roster change.
+func (dab *Database) AddAuditRecords(records []AuditRecord) error {
+	ids := make(map[string]string)
+	if len(records) == 1 {
+		ids[records[0].Student] = dab.userID(records[0].Student)
+	} else if len(records) > 1 {
+		var err error
+		ids, err = dab.emailIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	updates := make(map[string]interface{}, len(records))
+	for _, record := range records {
+		record.UserID = ids[record.Student]
+		updates[dbNewID()] = record
+	}
+	return dab.db.NewRef("/audit").Update(dab.ctx, updates)
+}
+
+// adds the records in the audit log whose child has a value to m.
+func (dab *Database) auditWhere(m map[string]AuditRecord, child string, value string) error {
+	found := make(map[string]AuditRecord)
+	err := dab.db.NewRef("/audit").OrderByChild(child).EqualTo(value).Get(dab.ctx, &found)
+	for id, record := range found {
+		m[id] = record
+	}
+	return err
+}
+
+// Method AuditLog returns the records in the audit log that match a search, newest first. Searches for a student, an
+// entry, or an action only read the records with that value, using the indexes in database.rules.json.
+func (dab *Database) AuditLog(q AuditQuery) ([]AuditRecord, error) {
+	studentID := ""
+	if q.Student != "" {
+		studentID = dab.userID(q.Student)
+	}
+
+	m := make(map[string]AuditRecord)
+	var err error
+	switch {
+	case studentID != "":
+		// Records are kept with the student's ID when their email changes
+		err = dab.auditWhere(m, "user_id", studentID)
+	case q.Student != "":
+		err = dab.auditWhere(m, "student", q.Student)
+	case q.Key != "":
+		err = dab.auditWhere(m, "key", q.Key)
+	case q.Action != "":
+		err = dab.auditWhere(m, "action", q.Action)
+	default:
+		err = dab.db.NewRef("/audit").OrderByKey().Get(dab.ctx, &m)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records := []AuditRecord(nil)
+	for id, record := range m {
+		record.ID = id
+		if q.Matches(record, studentID) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Time.After(records[j].Time)
+	})
+	return records, nil
+}
+
+// Method DeletionRequest returns the request to delete an entry, if there is one.
+func (dab *Database) DeletionRequest(email string, key string) (DeletionRequest, bool, error) {
+	req := DeletionRequest{}
+	id := dab.userID(email)
+	if id == "" {
+		return req, false, nil
+	}
+	err := dab.db.NewRef("/deletion_requests").Child(id).Child(key).Get(dab.ctx, &req)
+	if err != nil {
+		return req, false, err
+	}
+	req.Email = email
+	req.Key = key
+	return req, !req.Requested.IsZero(), nil
+}
+
+// Method DeletionRequests returns every request to delete an entry, oldest first.
+func (dab *Database) DeletionRequests() ([]DeletionRequest, error) {
+	byID := make(map[string]map[string]DeletionRequest)
+	err := dab.db.NewRef("/deletion_requests").OrderByKey().Get(dab.ctx, &byID)
+	if err != nil {
+		return nil, err
+	}
+	emails, err := dab.emailsByID()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []DeletionRequest(nil)
+	for id, reqs := range byID {
+		for key, req := range reqs {
+			req.Email = emails[id]
+			req.Key = key
+			out = append(out, req)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Requested.Before(out[j].Requested)
+	})
+	return out, nil
+}
+
+// Method SetDeletionRequest adds or replaces the request to delete an entry.
+func (dab *Database) SetDeletionRequest(req DeletionRequest) error {
+	id := dab.userID(req.Email)
+	if id == "" {
+		return EntryNotFound
+	}
+	return dab.db.NewRef("/deletion_requests").Child(id).Child(req.Key).Set(dab.ctx, req)
+}
+
+// Method RemoveDeletionRequest removes the request to delete an entry.
+func (dab *Database) RemoveDeletionRequest(email string, key string) error {
+	id := dab.userID(email)
+	if id == "" {
+		return nil
+	}
+	return dab.db.NewRef("/deletion_requests").Child(id).Child(key).Delete(dab.ctx)
 }
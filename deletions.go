@@ -0,0 +1,27 @@
+package main
+
+/* Withdrawals and deletion requests
+ *
+ * Students can withdraw their own entries while they can still edit them; withdrawn entries are moved to the
+ * trash like deleted ones. Older entries can't be changed by students, so they request that the entry be deleted
+ * instead, and the request waits in the review queue until an admin approves or denies it.
+ */
+
+import (
+	"time"
+)
+
+// Type DeletionRequest is a student's request to delete one of their entries.
+type DeletionRequest struct {
+	Email     string    `json:"-"`
+	Key       string    `json:"-"`
+	Reason    string    `json:"reason"`
+	Requested time.Time `json:"requested"`
+
+	// Set in the review queue
+	Student User   `json:"-"`
+	Entry   *Entry `json:"-"`
+}
+
+// The reason that withdrawn entries are in the trash
+const WITHDRAWN_REASON = "Withdrawn by the student"
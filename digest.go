@@ -0,0 +1,302 @@
+package main
+
+/* Weekly digest
+ *
+ * Once a week, admins and advisors are emailed a summary of what happened to their students: entries that
+ * were flagged, entries that are still awaiting review, students who fell behind pace, and roster changes.
+ * Admins cover every student; advisors cover the students in their classes and the students who list them
+ * as their advisor.
+ *
+ * Flagged entries and roster changes are logged as they happen, and the log is cleared after each digest.
+ */
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Type DigestFlag is an entry that was flagged since the last digest.
+type DigestFlag struct {
+	Email string `json:"email"`
+	Key   string `json:"key"`
+}
+
+// Type DigestLog is what happened since the last digest.
+type DigestLog struct {
+	Last     time.Time              `json:"last"`
+	Flagged  map[string]DigestFlag  `json:"flagged,omitempty"`
+	Roster   map[string]RosterEvent `json:"roster,omitempty"`
+	Progress map[string]string      `json:"progress,omitempty"` // Status of each student at the last digest, keyed by coded email
+}
+
+// Type DigestEntry is an entry in a digest.
+type DigestEntry struct {
+	Student User
+	Key     string
+	Entry   *Entry
+}
+
+// Type DigestGrade is the part of a digest about one grade.
+type DigestGrade struct {
+	Grade      uint // 0 for students who are not in grades 9-12
+	NewFlagged []DigestEntry
+	Awaiting   []DigestEntry // Every flagged entry, new or not
+	Behind     []Progress    // Students who were on track at the last digest and no longer are
+	Added      []User
+	Removed    []User
+	Changed    []User
+}
+
+// Type Digest is a summary of what happened to some students.
+type Digest struct {
+	Since  time.Time
+	Until  time.Time
+	Grades []DigestGrade
+}
+
+// Method Empty returns whether there is nothing to report.
+func (d Digest) Empty() bool {
+	return len(d.Grades) == 0
+}
+
+// Method Awaiting returns the number of entries awaiting review.
+func (d Digest) Awaiting() int {
+	count := 0
+	for _, grade := range d.Grades {
+		count += len(grade.Awaiting)
+	}
+	return count
+}
+
+// Type DigestData is everything that digests are built from.
+type DigestData struct {
+	Log      DigestLog
+	Now      time.Time
+	Users    map[string]User
+	Archive  map[string]ArchivedUser
+	Entries  map[string]EntryList
+	Progress []Progress
+}
+
+// returns a user on the roster or in the archive. Users that no longer exist only have an email.
+func (data DigestData) user(email string) User {
+	if user, ok := data.Users[email]; ok {
+		return user
+	}
+	if archived, ok := data.Archive[email]; ok {
+		return archived.User
+	}
+	return User{Name: email, Email: email}
+}
+
+// Function BuildDigest summarizes what happened to the students that covers returns true for.
+func BuildDigest(data DigestData, covers func(email string) bool) Digest {
+	grades := make(map[uint]*DigestGrade)
+	grade := func(user User) *DigestGrade {
+		g := user.GradeAt(data.Now)
+		if user.Grade == 0 || g < 9 || g > 12 {
+			g = 0
+		}
+		if grades[g] == nil {
+			grades[g] = &DigestGrade{Grade: g}
+		}
+		return grades[g]
+	}
+
+	seen := make(map[DigestFlag]bool)
+	for _, flag := range data.Log.Flagged {
+		entry, ok := data.Entries[flag.Email][flag.Key]
+		if !ok || !entry.Flagged || seen[flag] || !covers(flag.Email) {
+			continue
+		}
+		seen[flag] = true
+		student := data.user(flag.Email)
+		g := grade(student)
+		g.NewFlagged = append(g.NewFlagged, DigestEntry{Student: student, Key: flag.Key, Entry: entry})
+	}
+
+	for email, list := range data.Entries {
+		if !covers(email) {
+			continue
+		}
+		for key, entry := range list {
+			if entry.Flagged {
+				student := data.user(email)
+				g := grade(student)
+				g.Awaiting = append(g.Awaiting, DigestEntry{Student: student, Key: key, Entry: entry})
+			}
+		}
+	}
+
+	for _, progress := range data.Progress {
+		email := progress.Student.Email
+		old, ok := data.Log.Progress[dbCodeEmail(email)]
+		if progress.Status == PROGRESS_ON_TRACK || (ok && old != PROGRESS_ON_TRACK) || !covers(email) {
+			continue
+		}
+		g := grade(progress.Student)
+		g.Behind = append(g.Behind, progress)
+	}
+
+	added, removed, changed := make(map[string]bool), make(map[string]bool), make(map[string]bool)
+	for _, event := range data.Log.Roster {
+		for _, email := range event.Added {
+			added[email] = true
+		}
+		for _, email := range event.Removed {
+			removed[email] = true
+		}
+		for _, email := range event.Changed {
+			changed[email] = true
+		}
+	}
+	for email := range added {
+		if covers(email) && !removed[email] {
+			g := grade(data.user(email))
+			g.Added = append(g.Added, data.user(email))
+		}
+	}
+	for email := range removed {
+		if covers(email) && !added[email] {
+			g := grade(data.user(email))
+			g.Removed = append(g.Removed, data.user(email))
+		}
+	}
+	for email := range changed {
+		if covers(email) && !added[email] && !removed[email] {
+			g := grade(data.user(email))
+			g.Changed = append(g.Changed, data.user(email))
+		}
+	}
+
+	digest := Digest{Since: data.Log.Last, Until: data.Now}
+	for _, g := range grades {
+		byStudent := func(list []DigestEntry) {
+			sort.Slice(list, func(i, j int) bool {
+				if list[i].Student.Name != list[j].Student.Name {
+					return list[i].Student.Name < list[j].Student.Name
+				}
+				return list[i].Entry.Date.Before(list[j].Entry.Date)
+			})
+		}
+		byName := func(list []User) {
+			sort.Slice(list, func(i, j int) bool {
+				return list[i].Name < list[j].Name
+			})
+		}
+		byStudent(g.NewFlagged)
+		byStudent(g.Awaiting)
+		sort.Slice(g.Behind, func(i, j int) bool {
+			return g.Behind[i].Student.Name < g.Behind[j].Student.Name
+		})
+		byName(g.Added)
+		byName(g.Removed)
+		byName(g.Changed)
+		digest.Grades = append(digest.Grades, *g)
+	}
+	// Grades 9-12 first, then everyone else
+	sort.Slice(digest.Grades, func(i, j int) bool {
+		return digest.Grades[i].Grade-1 < digest.Grades[j].Grade-1
+	})
+	return digest
+}
+
+// records events that are summarized in the next digest.
+func recordDigestEvent(event Event) {
+	var err error
+	switch data := event.Data.(type) {
+	case EntryEvent:
+		if event.Type == EVENT_ENTRY_FLAGGED {
+			err = database.LogDigestFlag(DigestFlag{Email: data.Email, Key: data.Key})
+		}
+	case RosterEvent:
+		err = database.LogDigestRoster(data)
+	}
+	if err != nil {
+		log.Printf("digest: %v", err)
+	}
+}
+
+// Function SendDigests emails a digest to every admin and advisor, then clears the log.
+func SendDigests(now time.Time) {
+	digestLog, err := database.DigestLog()
+	if err != nil {
+		log.Printf("digest: %v", err)
+		return
+	}
+	users, err := database.Users()
+	if err != nil {
+		log.Printf("digest: %v", err)
+		return
+	}
+	archive, err := database.Archive()
+	if err != nil {
+		log.Printf("digest: %v", err)
+		return
+	}
+	entries, err := database.ListAll()
+	if err != nil {
+		log.Printf("digest: %v", err)
+		return
+	}
+	advisors, err := database.Advisors()
+	if err != nil {
+		log.Printf("digest: %v", err)
+		return
+	}
+
+	data := DigestData{Log: digestLog, Now: now, Users: users, Archive: archive, Entries: entries}
+	if data.Log.Last.IsZero() {
+		data.Log.Last = now.AddDate(0, 0, -7)
+	}
+	data.Progress = ProgressReport(data.Users, data.Entries, calendar, now)
+
+	sent := make(map[string]bool)
+	send := func(to User, digest Digest, advisor bool) {
+		if digest.Empty() || sent[to.Email] {
+			return
+		}
+		sent[to.Email] = true
+		Notify(NOTIFY_DIGEST, to, map[string]interface{}{
+			"Digest":  digest,
+			"Advisor": advisor,
+		})
+	}
+
+	for _, user := range data.Users {
+		if user.Admin {
+			send(user, BuildDigest(data, func(string) bool { return true }), false)
+		}
+	}
+
+	for _, advisor := range advisors {
+		students := make(map[string]bool)
+		for _, email := range advisor.Students {
+			students[email] = true
+		}
+		for email, user := range data.Users {
+			if strings.EqualFold(user.Advisor, advisor.Email) {
+				students[email] = true
+			}
+		}
+
+		to := database.User(advisor.Email)
+		if to.Name == to.Email && advisor.Name != "" {
+			to.Name = advisor.Name
+		}
+		send(to, BuildDigest(data, func(email string) bool { return students[email] }), true)
+	}
+
+	statuses := make(map[string]string, len(data.Progress))
+	for _, progress := range data.Progress {
+		statuses[dbCodeEmail(progress.Student.Email)] = progress.Status
+	}
+	err = database.ClearDigestLog(data.Log, now, statuses)
+	if err != nil {
+		log.Printf("digest: %v", err)
+		return
+	}
+	log.Printf("sent %d digests", len(sent))
+}
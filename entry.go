@@ -11,16 +11,18 @@ import (
 )
 
 type Entry struct {
-	Name         string
-	Hours        uint
-	Date         time.Time
-	Organization string
-	ContactName  string
-	ContactEmail string
-	ContactPhone uint
-	Description  string
-	LastModified time.Time
-	Flagged      bool
+	Name             string
+	Hours            uint
+	Date             time.Time
+	Organization     string
+	ContactName      string
+	ContactEmail     string
+	ContactPhone     string // E.164, such as +19149373600
+	ContactExtension string
+	Description      string
+	LastModified     time.Time
+	Flagged          bool
+	Version          uint // Incremented on every change; entries from before versions were added have version 0
 }
 
 func NewEntry(name string, hours uint, org string) *Entry {
@@ -58,6 +60,37 @@ func (entry *Entry) SetFlagged() {
 	}
 }
 
+// Method Validate checks that the entry has everything that it needs. The error is a ValidationError.
+func (entry *Entry) Validate() error {
+	problems := make(ValidationError)
+	entry.validate(problems)
+	return problems.Err()
+}
+
+func (entry *Entry) validate(problems ValidationError) {
+	if strings.TrimSpace(entry.Name) == "" {
+		problems.Add("name", "name is missing")
+	}
+	if entry.Hours == 0 {
+		problems.Add("hours", "hours must be at least 1")
+	}
+	if entry.Date.IsZero() {
+		problems.Add("date", "date is missing")
+	}
+	if strings.TrimSpace(entry.Organization) == "" {
+		problems.Add("org", "organization is missing")
+	}
+	if entry.ContactEmail != "" && !validEmail(entry.ContactEmail) {
+		problems.Add("contact_email", fmt.Sprintf("invalid email: '%v'", entry.ContactEmail))
+	}
+	if entry.ContactPhone != "" && !phoneE164.MatchString(entry.ContactPhone) {
+		problems.Add("contact_phone", fmt.Sprintf("invalid phone number: '%v'", entry.ContactPhone))
+	}
+	if entry.ContactExtension != "" && (entry.ContactPhone == "" || !phoneDigits.MatchString(entry.ContactExtension)) {
+		problems.Add("contact_phone_ext", fmt.Sprintf("invalid extension: '%v'", entry.ContactExtension))
+	}
+}
+
 // Returns whether the entry is at most 30 days old
 func (entry *Entry) Editable() bool {
 	t := time.Now()
@@ -79,15 +112,21 @@ func (entry *Entry) MarshalJSON() ([]byte, error) {
 	if entry.ContactEmail != "" {
 		out["contact_email"] = entry.ContactEmail
 	}
-	if entry.ContactPhone != 0 {
+	if entry.ContactPhone != "" {
 		out["contact_phone"] = entry.ContactPhone
 	}
+	if entry.ContactExtension != "" {
+		out["contact_phone_ext"] = entry.ContactExtension
+	}
 	if entry.Description != "" {
 		out["description"] = entry.Description
 	}
 	if entry.Flagged {
 		out["flagged"] = true
 	}
+	if entry.Version != 0 {
+		out["version"] = entry.Version
+	}
 	return json.Marshal(out)
 }
 
@@ -112,10 +151,21 @@ func (entry *Entry) UnmarshalJSON(data []byte) error {
 		case "contact_email":
 			entry.ContactEmail = fmt.Sprint(val)
 		case "contact_phone":
-			h, ok := val.(float64)
-			if ok {
-				entry.ContactPhone = uint(h)
+			switch val := val.(type) {
+			case string:
+				// Numbers that aren't in E.164 are kept as they are, so that Validate can reject them
+				entry.ContactPhone = val
+				if number, ext, err := ParsePhone(val); err == nil {
+					entry.ContactPhone = number
+					if ext != "" {
+						entry.ContactExtension = ext
+					}
+				}
+			case float64:
+				entry.ContactPhone = LegacyPhone(uint64(val))
 			}
+		case "contact_phone_ext":
+			entry.ContactExtension = fmt.Sprint(val)
 		case "description":
 			entry.Description = fmt.Sprint(val)
 		case "last_modified":
@@ -124,37 +174,59 @@ func (entry *Entry) UnmarshalJSON(data []byte) error {
 			if valb, ok := val.(bool); ok {
 				entry.Flagged = valb
 			}
+		case "version":
+			v, ok := val.(float64)
+			if ok {
+				entry.Version = uint(v)
+			}
 		}
 	}
 	return nil
 }
 
-func EntryFromQuery(query url.Values) *Entry {
+// Function EntryFromQuery reads an entry from the entry form. If a field can't be read, a default is used so that
+// the entry can fill in a new form, and the problem is returned as a ValidationError along with any others.
+func EntryFromQuery(query url.Values) (*Entry, error) {
+	problems := make(ValidationError)
+
 	hours, err := strconv.ParseUint(query.Get("hours"), 10, 64)
 	if err != nil {
+		problems.Add("hours", fmt.Sprintf("invalid hours: '%v'", query.Get("hours")))
 		hours = 1
 	}
 	date, err := time.Parse("2006-01-02", query.Get("date"))
 	if err != nil {
+		problems.Add("date", fmt.Sprintf("invalid date: '%v'", query.Get("date")))
 		date = time.Now()
 	}
 
-	contactPhone, err := strconv.ParseUint(strings.NewReplacer("-", "", "+", "", " ", "").Replace(query.Get("contactphone")), 10, 64)
+	contactPhone, contactExtension := "", ""
+	if phone := strings.TrimSpace(query.Get("contactphone")); phone != "" {
+		contactPhone, contactExtension, err = ParsePhone(phone)
+		if err != nil {
+			problems.Add("contact_phone", err.Error())
+		}
+	}
+	version, err := strconv.ParseUint(query.Get("version"), 10, 64)
 	if err != nil {
-		contactPhone = 0
+		version = 0
 	}
 
-	return &Entry{
-		Name:         query.Get("name"),
-		Hours:        uint(hours),
-		Date:         date,
-		Organization: query.Get("org"),
-		ContactName:  query.Get("contactname"),
-		ContactEmail: query.Get("contactemail"),
-		Description:  query.Get("description"),
-		ContactPhone: uint(contactPhone),
-		LastModified: time.Now(),
+	entry := &Entry{
+		Name:             strings.TrimSpace(query.Get("name")),
+		Hours:            uint(hours),
+		Date:             date,
+		Organization:     strings.TrimSpace(query.Get("org")),
+		ContactName:      strings.TrimSpace(query.Get("contactname")),
+		ContactEmail:     strings.TrimSpace(query.Get("contactemail")),
+		Description:      query.Get("description"),
+		ContactPhone:     contactPhone,
+		ContactExtension: contactExtension,
+		LastModified:     time.Now(),
+		Version:          uint(version),
 	}
+	entry.validate(problems)
+	return entry, problems.Err()
 }
 
 func (entry *Entry) EncodeQuery() url.Values {
@@ -170,12 +242,20 @@ func (entry *Entry) EncodeQuery() url.Values {
 	if entry.ContactEmail != "" {
 		out.Set("contactemail", entry.ContactEmail)
 	}
-	if entry.ContactPhone != 0 {
-		out.Set("contactphone", strconv.FormatUint(uint64(entry.ContactPhone), 10))
+	if entry.ContactPhone != "" {
+		out.Set("contactphone", entry.Phone())
 	}
 	return out
 }
 
+// Method Phone returns the contact's phone number and extension as they are shown, or "" if there is no number.
+func (entry *Entry) Phone() string {
+	if entry.ContactPhone == "" {
+		return ""
+	}
+	return FormatPhone(entry.ContactPhone, entry.ContactExtension)
+}
+
 type EntryList map[string]*Entry
 
 func (l EntryList) Total() uint {
@@ -186,6 +266,19 @@ func (l EntryList) Total() uint {
 	return total
 }
 
+// Method Approved returns the total hours of entries that are not flagged. Entries are checked by SetFlagged when
+// they're made or changed, and a flagged entry only counts once an admin unflags it, so these are the hours that
+// certification counts as approved. There is no separate review of entries that were never flagged.
+func (l EntryList) Approved() uint {
+	total := uint(0)
+	for _, entry := range l {
+		if !entry.Flagged {
+			total += entry.Hours
+		}
+	}
+	return total
+}
+
 func (l EntryList) Keys() []string {
 	keylist := []string(nil)
 	for key, _ := range l {
@@ -200,3 +293,35 @@ func (l EntryList) SortKeys(keys []string) {
 		return l[keys[i]].Date.After(l[keys[j]].Date)
 	})
 }
+
+// Type EntryField is a field of two versions of an entry, as it is entered on the form.
+type EntryField struct {
+	Label  string
+	Mine   string
+	Theirs string
+}
+
+// Method Changed returns whether the versions differ.
+func (f EntryField) Changed() bool {
+	return f.Mine != f.Theirs
+}
+
+// Function CompareEntries returns the fields of two versions of an entry, in the order of the form.
+func CompareEntries(mine *Entry, theirs *Entry) []EntryField {
+	fields := []struct{ Name, Label string }{
+		{"name", "Name"},
+		{"hours", "Hours"},
+		{"date", "Date of Volunteering"},
+		{"org", "Service Organization"},
+		{"contactname", "Contact Name"},
+		{"contactemail", "Contact Email"},
+		{"contactphone", "Contact Phone"},
+		{"description", "Description"},
+	}
+	a, b := mine.EncodeQuery(), theirs.EncodeQuery()
+	out := make([]EntryField, len(fields))
+	for i, field := range fields {
+		out[i] = EntryField{Label: field.Label, Mine: a.Get(field.Name), Theirs: b.Get(field.Name)}
+	}
+	return out
+}
@@ -0,0 +1,120 @@
+package main
+
+/* Events
+ *
+ * Changes to entries and the roster, and comments on entries, are published as events. Subscribers that record events,
+ * such as the audit log and the webhook outbox, are called in the goroutine that published the event, so that the event
+ * is recorded before the change is reported. Subscribers that only act on events, such as emails, are called in the
+ * background, so that publishers aren't slowed down. Either way, subscribers are called in the order they subscribed.
+ */
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_ENTRY_CREATED   = "entry.created"
+	EVENT_ENTRY_UPDATED   = "entry.updated"
+	EVENT_ENTRY_FLAGGED   = "entry.flagged"   // An entry was added or changed and is now suspicious
+	EVENT_ENTRY_APPROVED  = "entry.approved"  // An admin unflagged an entry
+	EVENT_ENTRY_DELETED   = "entry.deleted"   // An admin moved an entry to the trash; if it was flagged, it was rejected
+	EVENT_ENTRY_RESTORED  = "entry.restored"  // An admin restored an entry from the trash
+	EVENT_ENTRY_PURGED    = "entry.purged"    // An entry was permanently deleted from the trash
+	EVENT_ENTRY_WITHDRAWN = "entry.withdrawn" // A student withdrew an entry, or an admin approved their request to delete it
+	EVENT_ENTRY_COMMENTED = "entry.commented" // Someone commented on an entry
+
+	EVENT_DELETION_REQUESTED = "entry.deletion_requested" // A student asked for an entry that they can no longer change to be deleted
+	EVENT_DELETION_DENIED    = "entry.deletion_denied"    // An admin denied a request to delete an entry
+
+	EVENT_ROSTER_UPDATED = "roster.updated"
+)
+
+// Every type of event, in the order they are shown
+var EventTypes = []string{
+	EVENT_ENTRY_CREATED,
+	EVENT_ENTRY_UPDATED,
+	EVENT_ENTRY_FLAGGED,
+	EVENT_ENTRY_APPROVED,
+	EVENT_ENTRY_DELETED,
+	EVENT_ENTRY_RESTORED,
+	EVENT_ENTRY_PURGED,
+	EVENT_ENTRY_WITHDRAWN,
+	EVENT_DELETION_REQUESTED,
+	EVENT_DELETION_DENIED,
+	EVENT_ENTRY_COMMENTED,
+	EVENT_ROSTER_UPDATED,
+}
+
+// Type Event is something that happened.
+type Event struct {
+	Type  string      `json:"type"`
+	Actor string      `json:"actor,omitempty"` // Email of the user who caused the event
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// Type EntryEvent is the data of entry events.
+type EntryEvent struct {
+	APIEntry
+	Previous *Entry `json:"previous,omitempty"` // The entry before it was updated; only set for entry.updated
+	Reason   string `json:"reason,omitempty"`   // Why the entry was deleted or its deletion was requested
+	Request  bool   `json:"request,omitempty"`  // The student had asked for the entry to be deleted; only set for entry.withdrawn
+}
+
+// Type CommentEvent is the data of entry.commented events.
+type CommentEvent struct {
+	Email   string  `json:"email"`
+	Key     string  `json:"key"`
+	Entry   *Entry  `json:"entry"`
+	Comment Comment `json:"comment"`
+}
+
+// Type RosterEvent is the data of roster.updated events. Each field is a list of emails.
+type RosterEvent struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"` // Archived or merged into another student
+	Changed []string `json:"changed,omitempty"`
+
+	Previous map[string]User `json:"-"` // Removed and changed users as they were before, keyed by their email after the change
+	Current  map[string]User `json:"-"` // Added and changed users as they are after the change, keyed by email
+}
+
+var (
+	subscribers      []func(Event)
+	asyncSubscribers []func(Event)
+	subscribersMutex sync.RWMutex
+)
+
+// Function subscribe calls fn with every event that is published from now on, before publish returns.
+func subscribe(fn func(Event)) {
+	subscribersMutex.Lock()
+	subscribers = append(subscribers, fn)
+	subscribersMutex.Unlock()
+}
+
+// Function subscribeAsync calls fn in the background with every event that is published from now on.
+func subscribeAsync(fn func(Event)) {
+	subscribersMutex.Lock()
+	asyncSubscribers = append(asyncSubscribers, fn)
+	subscribersMutex.Unlock()
+}
+
+// Function publish sends an event to every subscriber.
+func publish(eventType string, actor string, data interface{}) {
+	event := Event{Type: eventType, Actor: actor, Time: time.Now(), Data: data}
+
+	subscribersMutex.RLock()
+	defer subscribersMutex.RUnlock()
+	for _, fn := range subscribers {
+		fn(event)
+	}
+	if len(asyncSubscribers) != 0 {
+		async := asyncSubscribers
+		go func() {
+			for _, fn := range async {
+				fn(event)
+			}
+		}()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+/* In-app notifications
+ *
+ * Besides being emailed, users see some kinds of notifications in the app: the unread count is in the toolbar,
+ * and unread notifications are listed on the student's own page. They are kept whether or not the user opted out
+ * of the email. Read notifications are purged after NOTIFICATION_RETENTION.
+ */
+
+import (
+	"fmt"
+	"time"
+)
+
+const NOTIFICATION_RETENTION = 90 * 24 * time.Hour
+
+// Type Notification is a notification shown in the app.
+type Notification struct {
+	ID      string    `json:"-"`
+	Kind    string    `json:"kind"`
+	Text    string    `json:"text"`
+	Link    string    `json:"link"` // Page that the notification is about
+	Created time.Time `json:"created"`
+	Read    bool      `json:"read,omitempty"`
+}
+
+// Function NewNotification creates the in-app notification for a notification that is sent to a user. The data
+// is the same as the email template's. Returns false if the kind isn't shown in the app.
+func NewNotification(kind string, to User, data map[string]interface{}) (Notification, bool) {
+	n := Notification{Kind: kind, Link: "/" + to.Email, Created: time.Now()}
+
+	entry, _ := data["Entry"].(*Entry)
+	key, _ := data["Key"].(string)
+	switch {
+	case kind == NOTIFY_APPROVED && entry != nil:
+		n.Text = fmt.Sprintf("Your entry \"%s\" was approved.", entry.Name)
+		n.Link += "/" + key
+	case kind == NOTIFY_REJECTED && entry != nil:
+		n.Text = fmt.Sprintf("Your entry \"%s\" was not approved and was removed.", entry.Name)
+	case kind == NOTIFY_FLAGGED && entry != nil:
+		n.Text = fmt.Sprintf("Your entry \"%s\" was flagged for review. Make sure it has everything an administrator needs to approve it.", entry.Name)
+		n.Link += "/" + key
+	case kind == NOTIFY_COMMENT && entry != nil:
+		comment, _ := data["Comment"].(Comment)
+		student, _ := data["Student"].(User)
+		n.Text = fmt.Sprintf("%s commented on \"%s\".", comment.Name, entry.Name)
+		n.Link = "/" + student.Email + "/" + key
+	case kind == NOTIFY_DELETION && entry != nil:
+		if approved, _ := data["Approved"].(bool); approved {
+			n.Text = fmt.Sprintf("Your request to delete \"%s\" was approved.", entry.Name)
+		} else {
+			n.Text = fmt.Sprintf("Your request to delete \"%s\" was denied.", entry.Name)
+			n.Link += "/" + key
+		}
+	case kind == NOTIFY_DEADLINE:
+		progress, _ := data["Progress"].(Progress)
+		end, _ := data["End"].(time.Time)
+		n.Text = fmt.Sprintf("The school year ends on %s, and you have %d of the %d hours you need.", end.Format("January 2"), progress.Total, progress.Required)
+	case kind == NOTIFY_REMINDER:
+		n.Text, _ = data["Subject"].(string)
+	default:
+		return n, false
+	}
+	return n, true
+}
+
+// Function UnreadNotifications returns the notifications that are unread, in the same order.
+func UnreadNotifications(notifications []Notification) []Notification {
+	out := []Notification(nil)
+	for _, n := range notifications {
+		if !n.Read {
+			out = append(out, n)
+		}
+	}
+	return out
+}
@@ -0,0 +1,237 @@
+package main
+
+/* Notifications
+ *
+ * Users are emailed when something happens that concerns them. Each kind of notification has a template in
+ * files/mail, whose first line is the subject. Users can opt out of each kind on the Settings page. Some kinds are
+ * also shown in the app; see inbox.go.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	NOTIFY_APPROVED = "approved" // An admin approved one of the student's flagged entries
+	NOTIFY_REJECTED = "rejected" // An admin deleted one of the student's flagged entries
+	NOTIFY_FLAGGED  = "flagged"  // One of the student's entries was flagged for review
+	NOTIFY_DEADLINE = "deadline" // The end of the school year is near and the student hasn't met their requirement
+	NOTIFY_COMMENT  = "comment"  // Someone commented on the student's entry, or replied to a reviewer's comment
+	NOTIFY_DELETION = "deletion" // An admin approved or denied the student's request to delete an entry
+	NOTIFY_ROSTER   = "roster"   // The roster changed; sent to admins
+	NOTIFY_DIGEST   = "digest"   // Weekly summary; sent to admins and advisors
+	NOTIFY_REMINDER = "reminder" // Reminder campaign; sent to students who are behind
+)
+
+// Type NotificationKind describes a kind of notification on the Settings page.
+type NotificationKind struct {
+	Kind        string
+	Description string
+	Staff       bool // Only shown to admins and staff
+}
+
+var NotificationKinds = []NotificationKind{
+	{NOTIFY_APPROVED, "A flagged entry is approved", false},
+	{NOTIFY_REJECTED, "A flagged entry is rejected", false},
+	{NOTIFY_FLAGGED, "An entry is flagged for review", false},
+	{NOTIFY_COMMENT, "Someone comments on my entry or replies to my comment", false},
+	{NOTIFY_DELETION, "My request to delete an entry is approved or denied", false},
+	{NOTIFY_DEADLINE, "The end of the school year is near and I don't have enough hours", false},
+	{NOTIFY_REMINDER, "Administrators remind me that I need more hours", false},
+	{NOTIFY_ROSTER, "The roster changes (admins only)", true},
+	{NOTIFY_DIGEST, "Every week, with a summary of flagged entries and students who need help", true},
+}
+
+// Days before the end of the school year that students are reminded of the deadline
+var DEADLINE_NOTICES = []int{30, 7}
+
+var MAIL_TEMPLATES = template.Must(template.New("").Funcs(template.FuncMap{
+	"join":       strings.Join,
+	"fmtordinal": funcMap["fmtordinal"],
+}).ParseGlob("files/mail/*.txt"))
+
+// Type Preferences are a user's settings.
+type Preferences struct {
+	EmailOptOut map[string]bool `json:"email_opt_out,omitempty"` // Kinds of notifications that aren't emailed
+}
+
+// Method Wants returns whether the user wants to be emailed a kind of notification.
+func (p Preferences) Wants(kind string) bool {
+	return !p.EmailOptOut[kind]
+}
+
+// Function RenderNotification renders the email for a notification. The template is given data, along with
+// the recipient as User and the site's URL as Site.
+func RenderNotification(kind string, to User, data map[string]interface{}) (Message, error) {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["User"] = to
+	data["Site"] = strings.TrimSuffix(SITE_URL, "/")
+
+	buf := new(bytes.Buffer)
+	if err := MAIL_TEMPLATES.ExecuteTemplate(buf, kind+".txt", data); err != nil {
+		return Message{}, err
+	}
+
+	text := strings.TrimSpace(buf.String())
+	lines := strings.SplitN(text, "\n", 2)
+	if !strings.HasPrefix(lines[0], "Subject:") || len(lines) < 2 {
+		return Message{}, fmt.Errorf("%s.txt must start with a subject", kind)
+	}
+	return Message{
+		To:      to.Email,
+		Subject: strings.TrimSpace(strings.TrimPrefix(lines[0], "Subject:")),
+		Body:    strings.TrimSpace(lines[1]) + "\n",
+	}, nil
+}
+
+// Function Notify sends a notification to a user, unless they are disabled. It is shown in the app if its kind
+// is, and emailed unless they opted out of it. Returns whether the email was added to the outbox, which means that
+// it will be sent, or an error if it should have been but couldn't be. Errors are also logged.
+func Notify(kind string, to User, data map[string]interface{}) (bool, error) {
+	if to.Disabled {
+		return false, nil
+	}
+	if n, ok := NewNotification(kind, to, data); ok {
+		if err := database.AddNotification(to.Email, &n); err != nil {
+			log.Printf("notify: %v", err)
+		}
+	}
+	prefs, err := database.Preferences(to.Email)
+	if err != nil {
+		log.Printf("notify: %v", err)
+		return false, err
+	}
+	if !prefs.Wants(kind) {
+		return false, nil
+	}
+
+	msg, err := RenderNotification(kind, to, data)
+	if err != nil {
+		log.Printf("notify: %v", err)
+		return false, err
+	}
+	if err := mailQueue.Send(msg); err != nil {
+		log.Printf("notify: couldn't email %q to %s: %v", msg.Subject, msg.To, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// Function NotifyAdmins emails a notification to every active admin.
+func NotifyAdmins(kind string, data map[string]interface{}) {
+	users, err := database.Users()
+	if err != nil {
+		log.Printf("notify: %v", err)
+		return
+	}
+	for _, user := range users {
+		if user.Admin {
+			Notify(kind, user, data)
+		}
+	}
+}
+
+// sends the notifications for an event. It is subscribed with subscribeAsync, so it may be slow.
+func notifyEvent(event Event) {
+	switch data := event.Data.(type) {
+	case EntryEvent:
+		kind := ""
+		switch {
+		case event.Type == EVENT_ENTRY_APPROVED:
+			kind = NOTIFY_APPROVED
+		case event.Type == EVENT_ENTRY_DELETED && data.Entry.Flagged:
+			kind = NOTIFY_REJECTED
+		case event.Type == EVENT_ENTRY_FLAGGED:
+			kind = NOTIFY_FLAGGED
+		case event.Type == EVENT_ENTRY_WITHDRAWN && data.Request, event.Type == EVENT_DELETION_DENIED:
+			kind = NOTIFY_DELETION
+		default:
+			return
+		}
+		Notify(kind, database.User(data.Email), map[string]interface{}{
+			"Key":      data.Key,
+			"Entry":    data.Entry,
+			"Actor":    event.Actor,
+			"Reason":   data.Reason,
+			"Approved": event.Type == EVENT_ENTRY_WITHDRAWN,
+		})
+	case CommentEvent:
+		thread, err := database.Comments(data.Email, data.Key)
+		if err != nil {
+			log.Printf("notify: %v", err)
+			return
+		}
+		student := database.User(data.Email)
+		for _, email := range CommentRecipients(data.Email, data.Comment, thread) {
+			Notify(NOTIFY_COMMENT, database.User(email), map[string]interface{}{
+				"Student": student,
+				"Key":     data.Key,
+				"Entry":   data.Entry,
+				"Comment": data.Comment,
+			})
+		}
+	case RosterEvent:
+		NotifyAdmins(NOTIFY_ROSTER, map[string]interface{}{
+			"Added":   data.Added,
+			"Removed": data.Removed,
+			"Changed": data.Changed,
+			"Actor":   event.Actor,
+		})
+	}
+}
+
+// Function NotifyDeadlines reminds students who haven't met their requirement that the school year is ending.
+// Reminders are sent DEADLINE_NOTICES days before the end of the year, once each.
+func NotifyDeadlines(now time.Time) {
+	_, end := calendar.Year(now)
+	days := -1
+	for _, d := range DEADLINE_NOTICES {
+		if end.Sub(now) <= time.Duration(d)*24*time.Hour {
+			days = d
+		}
+	}
+	if days == -1 || now.After(end) {
+		return
+	}
+
+	notice := fmt.Sprintf("deadline-%s-%d", end.Format("2006-01-02"), days)
+	first, err := database.MarkNotice(notice)
+	if err != nil {
+		log.Printf("notify: %v", err)
+		return
+	}
+	if !first {
+		return
+	}
+
+	users, err := database.Users()
+	if err != nil {
+		log.Printf("notify: %v", err)
+		return
+	}
+	entries, err := database.ListAll()
+	if err != nil {
+		log.Printf("notify: %v", err)
+		return
+	}
+
+	count := 0
+	for _, progress := range ProgressReport(users, entries, calendar, now) {
+		if progress.Total >= progress.Required {
+			continue
+		}
+		Notify(NOTIFY_DEADLINE, progress.Student, map[string]interface{}{
+			"Progress": progress,
+			"End":      end,
+		})
+		count++
+	}
+	log.Printf("reminded %d students of the deadline", count)
+}
@@ -0,0 +1,241 @@
+package main
+
+/* OneRoster import
+ *
+ * Builds a roster from a OneRoster 1.1 CSV bundle, which is a zip file that contains users.csv, orgs.csv,
+ * and enrollments.csv among others.
+ */
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type Advisor is a staff member who may advise students.
+type Advisor struct {
+	Name     string   `json:"name"`
+	Email    string   `json:"email"`
+	Students []string `json:"students,omitempty"` // Emails of the students in the advisor's classes
+}
+
+// reads one CSV file of a OneRoster bundle as a list of rows keyed by header, along with the line that each row
+// starts on.
+func orReadFile(bundle *zip.Reader, name string) ([]map[string]string, []int, error) {
+	var file *zip.File
+	for _, f := range bundle.File {
+		if strings.EqualFold(f.Name, name) || strings.HasSuffix(strings.ToLower(f.Name), "/"+name) {
+			file = f
+			break
+		}
+	}
+	if file == nil {
+		return nil, nil, fmt.Errorf("%s is missing", name)
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+
+	reader := csv.NewReader(rc)
+	reader.FieldsPerRecord = -1
+	records := [][]string(nil)
+	lines := []int(nil)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		line, _ := reader.FieldPos(0)
+		records = append(records, record)
+		lines = append(lines, line)
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("%s is empty", name)
+	}
+
+	header := records[0]
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				row[strings.TrimSpace(column)] = strings.TrimSpace(record[i])
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, lines[1:], nil
+}
+
+// returns whether a row is active. OneRoster marks deleted rows with a status of "tobedeleted".
+func orActive(row map[string]string) bool {
+	return row["status"] != "tobedeleted" && row["enabledUser"] != "false"
+}
+
+// returns whether a row's email is an address alone. Emails are used as database keys, so they can't have
+// characters that keys can't have.
+func orEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s && !strings.ContainsAny(s, "#$[]/")
+}
+
+// Function UsersFromOneRoster reads the students and teachers in a OneRoster bundle at a given instant.
+//
+// Only students in 9th to 12th grade are included. If school is not empty, only users who belong to the
+// school with that name, identifier, or sourcedId are included. Teachers are returned as advisors along with
+// the students in their classes. Rows that cannot be read are returned as RowErrors; teachers' rows are marked.
+func UsersFromOneRoster(r io.ReaderAt, size int64, school string, t time.Time) ([]User, []Advisor, []RowError, error) {
+	bundle, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("not a zip file: %v", err)
+	}
+
+	orgs, _, err := orReadFile(bundle, "orgs.csv")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	users, lines, err := orReadFile(bundle, "users.csv")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	enrollments, _, err := orReadFile(bundle, "enrollments.csv")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Find the school
+	schools := make(map[string]bool)
+	for _, org := range orgs {
+		if school == "" || org["sourcedId"] == school || org["identifier"] == school || strings.EqualFold(org["name"], school) {
+			schools[org["sourcedId"]] = true
+		}
+	}
+	if len(schools) == 0 {
+		return nil, nil, nil, fmt.Errorf("school not found in orgs.csv: '%v'", school)
+	}
+
+	students := []User(nil)
+	emails := make(map[string]string) // sourcedId -> email
+	advisors := make(map[string]*Advisor)
+	rowErrors := []RowError(nil)
+	for i, row := range users {
+		if !orActive(row) {
+			continue
+		}
+
+		inSchool := false
+		for _, org := range strings.Split(row["orgSourcedIds"], ",") {
+			inSchool = inSchool || schools[strings.TrimSpace(org)]
+		}
+		if !inSchool {
+			continue
+		}
+
+		role := row["role"]
+		if role != "student" && role != "teacher" {
+			continue
+		}
+
+		rowError := func(err string) {
+			rowErrors = append(rowErrors, RowError{File: "users.csv", Line: lines[i], Err: err, Teacher: role == "teacher"})
+		}
+		if row["email"] == "" {
+			rowError("email is missing")
+			continue
+		}
+		if !orEmail(row["email"]) {
+			rowError(fmt.Sprintf("invalid email: '%v'", row["email"]))
+			continue
+		}
+		name := strings.TrimSpace(row["givenName"] + " " + row["familyName"])
+		if name == "" {
+			rowError("name is missing")
+			continue
+		}
+
+		if role == "teacher" {
+			advisors[row["sourcedId"]] = &Advisor{Name: name, Email: row["email"]}
+			continue
+		}
+
+		// A student may be in several grades; use the highest
+		grade := uint64(0)
+		for _, g := range strings.Split(row["grades"], ",") {
+			n, err := strconv.ParseUint(strings.TrimSpace(g), 10, 32)
+			if err == nil && n > grade {
+				grade = n
+			}
+		}
+		if grade < 9 || grade > 12 {
+			continue
+		}
+
+		students = append(students, User{
+			Name:      name,
+			Grade:     ClassOf(uint(grade), t),
+			Email:     row["email"],
+			StudentID: row["identifier"],
+			FirstName: row["givenName"],
+			LastName:  row["familyName"],
+		})
+		emails[row["sourcedId"]] = row["email"]
+	}
+
+	// Link teachers to the students in their classes
+	classStudents := make(map[string][]string)
+	classTeachers := make(map[string][]string)
+	for _, row := range enrollments {
+		if !orActive(row) || (row["schoolSourcedId"] != "" && !schools[row["schoolSourcedId"]]) {
+			continue
+		}
+		class := row["classSourcedId"]
+		switch row["role"] {
+		case "student":
+			if email, ok := emails[row["userSourcedId"]]; ok {
+				classStudents[class] = append(classStudents[class], email)
+			}
+		case "teacher":
+			classTeachers[class] = append(classTeachers[class], row["userSourcedId"])
+		}
+	}
+
+	out := []Advisor(nil)
+	for id, advisor := range advisors {
+		seen := make(map[string]bool)
+		for class, teachers := range classTeachers {
+			for _, teacher := range teachers {
+				if teacher != id {
+					continue
+				}
+				for _, email := range classStudents[class] {
+					if !seen[email] {
+						seen[email] = true
+						advisor.Students = append(advisor.Students, email)
+					}
+				}
+			}
+		}
+		sort.Strings(advisor.Students)
+		out = append(out, *advisor)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+
+	if len(students) == 0 {
+		return nil, nil, nil, fmt.Errorf("no students found")
+	}
+	return students, out, rowErrors, nil
+}
@@ -0,0 +1,360 @@
+package main
+
+/* OpenAPI specification
+ *
+ * The OpenAPI 3 document for the JSON API is generated from apiRoutes, so the paths always match the
+ * handlers. go test compares the document to a copy that is checked in, and CheckOpenAPI makes sure that the
+ * router agrees with that copy.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const OPENAPI_PATH = "/api/v1/openapi.json"
+
+// The Entry type has its own JSON encoding, so its schema is written by hand. CheckOpenAPI makes sure that
+// it matches Entry.MarshalJSON.
+var entrySchema = map[string]interface{}{
+	"type":     "object",
+	"required": []string{"name", "hours", "date", "org", "last_modified"},
+	"properties": map[string]interface{}{
+		"name":              map[string]interface{}{"type": "string"},
+		"hours":             map[string]interface{}{"type": "integer", "minimum": 0},
+		"date":              map[string]interface{}{"type": "string", "format": "date"},
+		"org":               map[string]interface{}{"type": "string"},
+		"contact_name":      map[string]interface{}{"type": "string"},
+		"contact_email":     map[string]interface{}{"type": "string", "format": "email"},
+		"contact_phone":     map[string]interface{}{"type": "string", "description": "E.164, such as +19149373600. Other formats are accepted and converted."},
+		"contact_phone_ext": map[string]interface{}{"type": "string", "pattern": "^[0-9]+$"},
+		"description":       map[string]interface{}{"type": "string"},
+		"last_modified":     map[string]interface{}{"type": "string", "format": "date", "readOnly": true},
+		"flagged":           map[string]interface{}{"type": "boolean", "readOnly": true},
+		"version":           map[string]interface{}{"type": "integer", "minimum": 0, "readOnly": true, "description": "Sent as the ETag. Send it in If-Match when replacing the entry, which fails with 412 if it was changed since"},
+	},
+}
+
+var openAPIParam = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// Type openAPISchemas collects the schemas of named types while the document is generated.
+type openAPISchemas map[string]interface{}
+
+// returns the schema of a Go type, as it is encoded by encoding/json. Structs are added to the components
+// and referenced by name.
+func (s openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(Entry{}):
+		s["Entry"] = entrySchema
+		return map[string]interface{}{"$ref": "#/components/schemas/Entry"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := s[t.Name()]; ok {
+			return ref
+		}
+		s[t.Name()] = nil // Allows recursive types
+
+		properties := make(map[string]interface{})
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			tag := strings.Split(field.Tag.Get("json"), ",")
+			name := tag[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = s.schema(field.Type)
+			if len(tag) < 2 || tag[1] != "omitempty" {
+				required = append(required, name)
+			}
+		}
+		s[t.Name()] = map[string]interface{}{
+			"type":       "object",
+			"required":   required,
+			"properties": properties,
+		}
+		return ref
+	}
+	panic(fmt.Sprintf("openapi: unsupported type %v", t))
+}
+
+// returns the status code of a successful request to a route. Routes without a response body return
+// 204 No Content, and POST requests that return a body create something.
+func (route APIRoute) successCode() string {
+	switch {
+	case route.Response == nil:
+		return "204"
+	case route.Method == "POST":
+		return "201"
+	}
+	return "200"
+}
+
+// Function OpenAPISpec generates the OpenAPI 3 document for the given routes.
+func OpenAPISpec(routes []APIRoute) map[string]interface{} {
+	schemas := openAPISchemas{
+		"Error": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"error"},
+			"properties": map[string]interface{}{
+				"error": map[string]interface{}{"type": "string"},
+				"fields": map[string]interface{}{
+					"type":                 "object",
+					"additionalProperties": map[string]interface{}{"type": "string"},
+					"description":          "What is wrong with each invalid field of the request body; only sent with 422",
+				},
+			},
+		},
+	}
+	errorResponse := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+				},
+			},
+		}
+	}
+
+	paths := make(map[string]interface{})
+	for _, route := range routes {
+		responses := map[string]interface{}{
+			"401": errorResponse("Not signed in"),
+			"403": errorResponse("Not allowed"),
+			"500": errorResponse("Internal error"),
+		}
+		success := map[string]interface{}{"description": "Success"}
+		if route.Response != nil {
+			success["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(route.Response))},
+			}
+		}
+		if _, ok := route.Response.(APIEntry); ok {
+			success["headers"] = map[string]interface{}{
+				"ETag": map[string]interface{}{
+					"description": "The entry's version, in quotes",
+					"schema":      map[string]interface{}{"type": "string"},
+				},
+			}
+		}
+		responses[route.successCode()] = success
+		if _, ok := route.Response.(User); ok {
+			responses["404"] = errorResponse("User not found")
+		}
+
+		operation := map[string]interface{}{
+			"summary":   route.Summary,
+			"responses": responses,
+		}
+
+		params := []interface{}{}
+		for _, match := range openAPIParam.FindAllStringSubmatch(route.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+			if match[1] == "key" {
+				responses["404"] = errorResponse("Entry not found")
+			}
+		}
+		if route.Method == "PUT" {
+			params = append(params, map[string]interface{}{
+				"name":        "If-Match",
+				"in":          "header",
+				"required":    true,
+				"description": "The ETag of the entry that the change was made to, or * to replace any version",
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+			responses["412"] = errorResponse("The entry was changed since the version in If-Match")
+			responses["428"] = errorResponse("If-Match is missing")
+		}
+		if len(params) != 0 {
+			operation["parameters"] = params
+		}
+
+		if route.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(route.Request))},
+				},
+			}
+			responses["400"] = errorResponse("Invalid JSON")
+			responses["415"] = errorResponse("Not JSON")
+			responses["422"] = errorResponse("Invalid fields")
+		}
+
+		item, ok := paths[route.Path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	paths[OPENAPI_PATH] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":  "This document",
+			"security": []interface{}{},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "Success",
+					"content":     map[string]interface{}{"application/json": map[string]interface{}{}},
+				},
+			},
+		},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "BBCS Service Hours API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}(schemas),
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": "BBCS_SESSION_ID",
+				},
+				"token": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A personal API token from /tokens",
+				},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"session": []string{}},
+			map[string]interface{}{"token": []string{}},
+		},
+	}
+}
+
+// Function CheckOpenAPI returns an error if the routes under /api/ of a router are not the same as the paths
+// in an OpenAPI document, or if the Entry schema does not match its JSON encoding.
+func CheckOpenAPI(router *mux.Router, spec map[string]interface{}) error {
+	problems := []string{}
+
+	documented := make(map[string]bool)
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	served := make(map[string]bool)
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s has no methods", path))
+			return nil
+		}
+		for _, method := range methods {
+			served[method+" "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for route := range served {
+		if !documented[route] {
+			problems = append(problems, fmt.Sprintf("%s is not documented", route))
+		}
+	}
+	for route := range documented {
+		if !served[route] {
+			problems = append(problems, fmt.Sprintf("%s is documented but not served", route))
+		}
+	}
+
+	// Every field of an entry is set, so every property is encoded
+	sample := &Entry{
+		Name: "a", Hours: 1, Date: time.Now(), Organization: "a", ContactName: "a", ContactEmail: "a",
+		ContactPhone: "a", ContactExtension: "1", Description: "a", LastModified: time.Now(), Flagged: true, Version: 1,
+	}
+	data, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	encoded := make(map[string]interface{})
+	json.Unmarshal(data, &encoded)
+	properties := entrySchema["properties"].(map[string]interface{})
+	for name := range encoded {
+		if _, ok := properties[name]; !ok {
+			problems = append(problems, fmt.Sprintf("Entry property %s is not documented", name))
+		}
+	}
+	for name := range properties {
+		if _, ok := encoded[name]; !ok {
+			problems = append(problems, fmt.Sprintf("Entry property %s is documented but not encoded", name))
+		}
+	}
+
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("openapi: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Function OpenAPIHandler serves an OpenAPI document. It does not require authentication.
+func OpenAPIHandler(spec map[string]interface{}) http.HandlerFunc {
+	data, err := json.MarshalIndent(spec, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(data)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/openapi.json from apiRoutes")
+
+func TestOpenAPI(t *testing.T) {
+	generated := OpenAPISpec(apiRoutes)
+	r := mux.NewRouter()
+	AddAPIRoutes(r, generated)
+
+	// The document is generated from the same routes as the router, so both are checked against the document
+	// that was checked in. Changes to the API show up as changes to that file.
+	data, err := json.MarshalIndent(generated, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, '\n')
+	if *update {
+		if err := ioutil.WriteFile("testdata/openapi.json", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkedIn, err := ioutil.ReadFile("testdata/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, checkedIn) {
+		t.Error("the OpenAPI document differs from testdata/openapi.json; check the differences and run go test -update")
+	}
+
+	spec := make(map[string]interface{})
+	if err := json.Unmarshal(checkedIn, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckOpenAPI(r, spec); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every documented operation must reach the route with its own path, and not one that is registered first
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		url := openAPIParam.ReplaceAllString(path, "x")
+		for method := range item.(map[string]interface{}) {
+			method = strings.ToUpper(method)
+			var match mux.RouteMatch
+			if !r.Match(httptest.NewRequest(method, url, nil), &match) || match.MatchErr != nil {
+				t.Errorf("%s %s is not routed", method, path)
+				continue
+			}
+			if template, _ := match.Route.GetPathTemplate(); template != path {
+				t.Errorf("%s %s is routed to %s", method, path, template)
+			}
+		}
+	}
+}
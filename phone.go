@@ -0,0 +1,102 @@
+package main
+
+/* Phone numbers
+ *
+ * Contact phone numbers are stored in E.164 format, such as +19149373600, and their extensions are stored
+ * separately. Numbers that are entered without a country code are in phoneCountryCode. Before numbers were stored
+ * this way, they were stored as integers with their punctuation removed; LegacyPhone converts them.
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Country calling code of numbers that are entered without one. "1" is the North American Numbering Plan.
+var phoneCountryCode = "1"
+
+var (
+	phoneE164        = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+	phoneExtension   = regexp.MustCompile(`(?i)\s*(?:ext\.?|extension|x|#)\s*([0-9]+)$`)
+	phoneDigits      = regexp.MustCompile(`^[0-9]+$`)
+	phonePunctuation = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "", "/", "")
+)
+
+// Function SetPhoneCountryCode sets the country calling code of numbers that are entered without one.
+func SetPhoneCountryCode(code string) error {
+	code = strings.TrimPrefix(strings.TrimSpace(code), "+")
+	if !phoneDigits.MatchString(code) || len(code) > 3 || code[0] == '0' {
+		return fmt.Errorf("invalid country calling code: '%v'", code)
+	}
+	phoneCountryCode = code
+	return nil
+}
+
+// Function ParsePhone converts a phone number, as it is entered, to E.164. Numbers that start with "+" or "00", the
+// international prefix in most countries, have a country code. The extension, if any, follows the number after
+// "ext", "x", or "#".
+func ParsePhone(s string) (number string, ext string, err error) {
+	invalid := fmt.Errorf("invalid phone number: '%v'", s)
+
+	number = strings.TrimSpace(s)
+	if m := phoneExtension.FindStringSubmatchIndex(number); m != nil {
+		ext = number[m[2]:m[3]]
+		number = number[:m[0]]
+	}
+
+	if strings.HasPrefix(number, "+") || strings.HasPrefix(number, "00") {
+		// A 0 in parentheses, as in +44 (0)20, is only dialed within the country
+		number = strings.Replace(number, "(0)", "", 1)
+	}
+	number = phonePunctuation.Replace(number)
+	if strings.HasPrefix(number, "+") {
+		number = number[1:]
+	} else if strings.HasPrefix(number, "00") {
+		number = number[2:]
+	} else if phoneCountryCode == "1" {
+		// North American numbers have 10 digits, and may be dialed with a 1 first
+		if len(number) == 11 && number[0] == '1' {
+			number = number[1:]
+		}
+		if len(number) != 10 {
+			return "", "", invalid
+		}
+		number = phoneCountryCode + number
+	} else {
+		// Elsewhere, national numbers are usually dialed with a 0 first
+		number = phoneCountryCode + strings.TrimPrefix(number, "0")
+	}
+
+	number = "+" + number
+	if !phoneE164.MatchString(number) {
+		return "", "", invalid
+	}
+	if strings.HasPrefix(number, "+1") && len(number) != 12 {
+		return "", "", invalid
+	}
+	return number, ext, nil
+}
+
+// Function FormatPhone formats a number and an extension to be shown. North American numbers are shown as
+// +1 914-937-3600, and others as they are stored.
+func FormatPhone(number string, ext string) string {
+	if strings.HasPrefix(number, "+1") && len(number) == 12 {
+		number = fmt.Sprintf("+1 %s-%s-%s", number[2:5], number[5:8], number[8:])
+	}
+	if ext != "" {
+		number += " ext. " + ext
+	}
+	return number
+}
+
+// Function LegacyPhone converts a number that was stored as an integer. It is read as if it was entered without
+// a country code, and if it can't be, as if it was entered with one.
+func LegacyPhone(n uint64) string {
+	digits := strconv.FormatUint(n, 10)
+	if number, _, err := ParsePhone(digits); err == nil {
+		return number
+	}
+	return "+" + digits
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	PROGRESS_ON_TRACK = "ontrack"
+	PROGRESS_BEHIND   = "behind"
+	PROGRESS_AT_RISK  = "atrisk"
+)
+
+// Type Calendar represents the first and last days of the school year.
+type Calendar struct {
+	StartMonth time.Month
+	StartDay   int
+	EndMonth   time.Month
+	EndDay     int
+}
+
+var DefaultCalendar = Calendar{time.September, 1, time.June, 20}
+
+// Function ParseCalendar parses the first and last days of the school year, each formatted as MM-DD.
+// Empty strings are replaced with the defaults.
+func ParseCalendar(start string, end string) (Calendar, error) {
+	cal := DefaultCalendar
+	if start != "" {
+		t, err := time.Parse("01-02", start)
+		if err != nil {
+			return cal, fmt.Errorf("invalid start of school year: '%v'", start)
+		}
+		cal.StartMonth, cal.StartDay = t.Month(), t.Day()
+	}
+	if end != "" {
+		t, err := time.Parse("01-02", end)
+		if err != nil {
+			return cal, fmt.Errorf("invalid end of school year: '%v'", end)
+		}
+		cal.EndMonth, cal.EndDay = t.Month(), t.Day()
+	}
+	return cal, nil
+}
+
+// Method Year returns the first and last days of the school year containing a given instant.
+// Like User.GradeAt, school years change over in July.
+func (cal Calendar) Year(t time.Time) (time.Time, time.Time) {
+	year := t.Year()
+	if t.Month() < time.July {
+		year -= 1
+	}
+	start := time.Date(year, cal.StartMonth, cal.StartDay, 0, 0, 0, 0, t.Location())
+	end := time.Date(year+1, cal.EndMonth, cal.EndDay, 23, 59, 59, 0, t.Location())
+	return start, end
+}
+
+// Method Elapsed returns the fraction of the school year that has passed at a given instant, between 0 and 1.
+func (cal Calendar) Elapsed(t time.Time) float64 {
+	start, end := cal.Year(t)
+	fraction := t.Sub(start).Hours() / end.Sub(start).Hours()
+	return math.Max(0, math.Min(1, fraction))
+}
+
+// Type Progress describes how a student's hours compare to their requirement.
+type Progress struct {
+	Student   User
+	Grade     uint
+	Total     uint
+	Expected  uint // Hours expected by now
+	Projected uint // Hours expected by the end of the year at the student's current pace
+	Required  uint // Hours required by the end of the year
+	Status    string
+}
+
+// Function ProgressAt computes a student's progress at a given instant.
+//
+// Requirements accrue evenly over each school year, starting from 9th grade (or later for students who
+// are late). A student is on track if they have done the hours expected by now, behind if they are not
+// but will reach their requirement at their current pace, and at risk otherwise.
+func ProgressAt(user User, entries EntryList, cal Calendar, t time.Time) Progress {
+	grade := user.GradeAt(t)
+	requiredYears := math.Max(0, float64(grade)-8-float64(user.Late))
+	years := math.Max(0, requiredYears-1+cal.Elapsed(t))
+
+	p := Progress{
+		Student:  user,
+		Grade:    grade,
+		Total:    entries.Total(),
+		Expected: uint(math.Floor(years * 20)),
+		Required: uint(requiredYears * 20),
+	}
+
+	if years > 0 {
+		p.Projected = uint(math.Floor(float64(p.Total) / years * requiredYears))
+	} else {
+		p.Projected = p.Total
+	}
+
+	switch {
+	case p.Total >= p.Expected || p.Total >= p.Required:
+		p.Status = PROGRESS_ON_TRACK
+	case p.Projected >= p.Required:
+		p.Status = PROGRESS_BEHIND
+	default:
+		p.Status = PROGRESS_AT_RISK
+	}
+	return p
+}
+
+// Function ProgressReport computes the progress of every student in grades 9-12, sorted by grade and name.
+func ProgressReport(users map[string]User, entries map[string]EntryList, cal Calendar, t time.Time) []Progress {
+	out := []Progress(nil)
+	for email, user := range users {
+		grade := user.GradeAt(t)
+		if user.Grade == 0 || grade < 9 || grade > 12 {
+			continue
+		}
+		out = append(out, ProgressAt(user, entries[email], cal, t))
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Grade != out[j].Grade {
+			return out[i].Grade < out[j].Grade
+		}
+		return out[i].Student.Name < out[j].Student.Name
+	})
+	return out
+}
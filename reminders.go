@@ -0,0 +1,286 @@
+package main
+
+/* Reminder campaigns
+ *
+ * Admins can email a reminder to every student whose approved hours are short of their requirement by at
+ * least some margin. A campaign is sent right away or at a scheduled time; either way, the students are
+ * chosen when it is sent, and each one is recorded along with their hours at the time. Each student is also
+ * recorded as soon as they are reminded, so that a campaign that fails partway can be resumed without reminding
+ * anyone twice.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	CAMPAIGN_SCHEDULED = "scheduled"
+	CAMPAIGN_SENDING   = "sending"
+	CAMPAIGN_SENT      = "sent"
+	CAMPAIGN_CANCELLED = "cancelled"
+	CAMPAIGN_FAILED    = "failed" // Sending stopped because of an error, and can be resumed
+)
+
+// Type CampaignRecipient is a student who is or was reminded.
+type CampaignRecipient struct {
+	Email    string    `json:"email"`
+	Name     string    `json:"name"`
+	Grade    uint      `json:"grade"`
+	Approved uint      `json:"approved"`
+	Required uint      `json:"required"`
+	Sent     time.Time `json:"sent,omitempty"`
+	OptedOut bool      `json:"opted_out,omitempty"`
+}
+
+// Method Done returns whether the student was reminded, or would have been if they hadn't opted out.
+func (r CampaignRecipient) Done() bool {
+	return !r.Sent.IsZero() || r.OptedOut
+}
+
+// Method Missing returns the # of hours the student is short by.
+func (r CampaignRecipient) Missing() uint {
+	return r.Required - r.Approved
+}
+
+// Type Campaign is a reminder sent to students who are behind.
+type Campaign struct {
+	ID         string              `json:"-"`
+	Subject    string              `json:"subject"`
+	Message    string              `json:"message"` // Template; see CampaignFromQuery
+	Margin     uint                `json:"margin"`  // Students are reminded if they are short by at least this many hours
+	Grades     []uint              `json:"grades"`
+	Scheduled  time.Time           `json:"scheduled"`
+	Status     string              `json:"status"`
+	Created    time.Time           `json:"created"`
+	CreatedBy  string              `json:"created_by"`
+	Recipients []CampaignRecipient `json:"recipients,omitempty"` // Set when the campaign is sent
+	Error      string              `json:"error,omitempty"`      // Why sending failed
+}
+
+// The message that the form starts with
+const DEFAULT_CAMPAIGN_MESSAGE = `You have {{.Approved}} approved hours of community service, but you need {{.Required}} by the end of this school year. Please add your hours soon.`
+
+// Function CampaignFromQuery reads a campaign from the form on the Reminders page.
+//
+// The message is a template, which can use {{.Name}}, {{.Approved}}, {{.Required}}, and {{.Missing}}. If the
+// scheduled time is empty, the campaign is sent now.
+func CampaignFromQuery(query url.Values, loc *time.Location) (Campaign, error) {
+	c := Campaign{
+		Subject: strings.TrimSpace(query.Get("subject")),
+		Message: strings.TrimSpace(query.Get("message")),
+		Status:  CAMPAIGN_SCHEDULED,
+		Created: time.Now(),
+	}
+	if c.Subject == "" {
+		return c, fmt.Errorf("subject is missing")
+	}
+	if c.Message == "" {
+		return c, fmt.Errorf("message is missing")
+	}
+	if _, err := template.New("").Parse(c.Message); err != nil {
+		return c, fmt.Errorf("invalid message: %v", err)
+	}
+
+	margin, err := strconv.ParseUint(query.Get("margin"), 10, 16)
+	if err != nil {
+		return c, fmt.Errorf("invalid margin: '%v'", query.Get("margin"))
+	}
+	c.Margin = uint(margin)
+
+	for _, g := range query["grade"] {
+		grade, err := strconv.ParseUint(g, 10, 8)
+		if err != nil || grade < 9 || grade > 12 {
+			return c, fmt.Errorf("invalid grade: '%v'", g)
+		}
+		c.Grades = append(c.Grades, uint(grade))
+	}
+	if len(c.Grades) == 0 {
+		return c, fmt.Errorf("no grades selected")
+	}
+
+	c.Scheduled = c.Created
+	if query.Get("send_at") != "" {
+		c.Scheduled, err = time.ParseInLocation("2006-01-02T15:04", query.Get("send_at"), loc)
+		if err != nil {
+			return c, fmt.Errorf("invalid time: '%v'", query.Get("send_at"))
+		}
+	}
+	return c, nil
+}
+
+// Method EncodeQuery is the opposite of CampaignFromQuery.
+func (c Campaign) EncodeQuery() url.Values {
+	query := url.Values{}
+	query.Set("subject", c.Subject)
+	query.Set("message", c.Message)
+	query.Set("margin", fmt.Sprint(c.Margin))
+	for _, grade := range c.Grades {
+		query.Add("grade", fmt.Sprint(grade))
+	}
+	if c.Scheduled.After(c.Created) {
+		query.Set("send_at", c.Scheduled.Format("2006-01-02T15:04"))
+	}
+	return query
+}
+
+// Method HasGrade returns whether the campaign targets a grade.
+func (c Campaign) HasGrade(grade uint) bool {
+	for _, g := range c.Grades {
+		if g == grade {
+			return true
+		}
+	}
+	return false
+}
+
+// Method RecipientsAt returns the students that would be reminded at a given instant, sorted by grade and name.
+func (c Campaign) RecipientsAt(users map[string]User, entries map[string]EntryList, t time.Time) []CampaignRecipient {
+	out := []CampaignRecipient(nil)
+	for email, user := range users {
+		grade := user.GradeAt(t)
+		if user.Grade == 0 || user.Disabled || !c.HasGrade(grade) || grade < 9+user.Late {
+			continue
+		}
+
+		required := user.RequiredBy(grade)
+		approved := entries[email].Approved()
+		if approved >= required || required-approved < c.Margin {
+			continue
+		}
+		out = append(out, CampaignRecipient{
+			Email:    email,
+			Name:     user.Name,
+			Grade:    grade,
+			Approved: approved,
+			Required: required,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Grade != out[j].Grade {
+			return out[i].Grade < out[j].Grade
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// Method Render returns the message for a recipient.
+func (c Campaign) Render(r CampaignRecipient) (string, error) {
+	tmpl, err := template.New("").Parse(c.Message)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	err = tmpl.Execute(buf, map[string]interface{}{
+		"Name":     r.Name,
+		"Approved": r.Approved,
+		"Required": r.Required,
+		"Missing":  r.Missing(),
+	})
+	return buf.String(), err
+}
+
+var campaignMutex sync.Mutex
+
+// Function SendDueCampaigns sends every scheduled campaign whose time has come.
+func SendDueCampaigns() {
+	campaignMutex.Lock()
+	defer campaignMutex.Unlock()
+
+	campaigns, err := database.Campaigns()
+	if err != nil {
+		log.Printf("reminders: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, c := range campaigns {
+		// Campaigns are only sent while campaignMutex is held, so this one was interrupted by a restart
+		if c.Status == CAMPAIGN_SENDING {
+			failCampaign(c, fmt.Errorf("sending was interrupted"))
+			continue
+		}
+		if c.Status != CAMPAIGN_SCHEDULED || c.Scheduled.After(now) {
+			continue
+		}
+		if err := sendCampaign(c, now); err != nil {
+			log.Printf("reminders: %v", err)
+		}
+	}
+}
+
+// sends a campaign and records who was reminded. A campaign that already has recipients was resumed, and only
+// the students who weren't reminded yet are.
+func sendCampaign(c Campaign, now time.Time) error {
+	ok, err := database.SetCampaignStatus(c.ID, CAMPAIGN_SCHEDULED, CAMPAIGN_SENDING)
+	if err != nil || !ok {
+		return err
+	}
+	c.Status = CAMPAIGN_SENDING
+	c.Error = ""
+
+	users, err := database.Users()
+	if err != nil {
+		return failCampaign(c, err)
+	}
+
+	if c.Recipients == nil {
+		entries, err := database.ListAll()
+		if err != nil {
+			return failCampaign(c, err)
+		}
+		c.Recipients = c.RecipientsAt(users, entries, now)
+		if err := database.SetCampaign(&c); err != nil {
+			return failCampaign(c, err)
+		}
+	}
+
+	for i, r := range c.Recipients {
+		if r.Done() {
+			continue
+		}
+		body, err := c.Render(r)
+		if err != nil {
+			return failCampaign(c, err)
+		}
+		// Students who opted out are recorded without a time. Students whose email couldn't be queued aren't
+		// recorded, so that they are reminded if the campaign is resumed.
+		sent, err := Notify(NOTIFY_REMINDER, users[r.Email], map[string]interface{}{"Subject": c.Subject, "Body": body})
+		if err != nil {
+			return failCampaign(c, err)
+		}
+		if sent {
+			c.Recipients[i].Sent = time.Now()
+		} else {
+			c.Recipients[i].OptedOut = true
+		}
+		if err := database.SetCampaignRecipient(c.ID, i, c.Recipients[i]); err != nil {
+			return failCampaign(c, err)
+		}
+	}
+
+	c.Status = CAMPAIGN_SENT
+	log.Printf("sent reminder %q to %d students", c.Subject, len(c.Recipients))
+	return database.SetCampaign(&c)
+}
+
+// marks a campaign as failed, along with the students who were reminded so far, and returns the error.
+func failCampaign(c Campaign, err error) error {
+	c.Status = CAMPAIGN_FAILED
+	c.Error = err.Error()
+	if err := database.SetCampaign(&c); err != nil {
+		log.Printf("reminders: %v", err)
+	}
+	return fmt.Errorf("reminder %q failed: %v", c.Subject, err)
+}
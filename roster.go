@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Previews are kept in the database for an hour, so that they can be applied after a restart
+const ROSTER_PREVIEW_EXPIRY = time.Hour
+
+// Type RosterChange is a student whose graduation year or # of years late changes.
+type RosterChange struct {
+	Old User `json:"old"`
+	New User `json:"new"`
+}
+
+// Type RosterPreview describes what would happen if a roster were applied.
+type RosterPreview struct {
+	Users    []User         `json:"users,omitempty"`    // The students on the new roster
+	Added    []User         `json:"added,omitempty"`    // Students who are not on the current roster
+	Removed  []User         `json:"removed,omitempty"`  // Students who would be archived
+	Changed  []RosterChange `json:"changed,omitempty"`  // Students whose graduation year or # of years late would change
+	Errors   []RowError     `json:"errors,omitempty"`   // Students' rows that could not be read; the roster can't be applied until they are fixed
+	Skipped  []RowError     `json:"skipped,omitempty"`  // Teachers' rows that could not be read; the roster is applied without them
+	Orphaned []string       `json:"orphaned,omitempty"` // Emails with entries that would not belong to any student, archived or not
+	Advisors []Advisor      `json:"advisors,omitempty"` // Teachers from a OneRoster bundle; nil for other rosters
+	Partial  bool           `json:"partial,omitempty"`  // Whether the roster only adds or updates students
+	Version  string         `json:"version"`            // Version of the roster that the preview was made from
+	Created  time.Time      `json:"created"`
+}
+
+// Function PreviewRoster compares a new roster to the current users. If partial is true, students who are not
+// on the new roster are left alone.
+func PreviewRoster(users []User, rowErrors []RowError, partial bool, oldUsers map[string]User, archive map[string]ArchivedUser, entries map[string]EntryList) *RosterPreview {
+	preview := &RosterPreview{
+		Users:   users,
+		Partial: partial,
+		Created: time.Now(),
+	}
+	for _, rowError := range rowErrors {
+		if rowError.Teacher {
+			preview.Skipped = append(preview.Skipped, rowError)
+		} else {
+			preview.Errors = append(preview.Errors, rowError)
+		}
+	}
+
+	onRoster := make(map[string]bool)
+	for _, user := range users {
+		onRoster[user.Email] = true
+
+		oldUser, ok := oldUsers[user.Email]
+		switch {
+		case !ok:
+			preview.Added = append(preview.Added, user)
+		case !oldUser.Admin && (oldUser.Grade != user.Grade || oldUser.Late != user.Late):
+			preview.Changed = append(preview.Changed, RosterChange{Old: oldUser, New: user})
+		}
+	}
+
+	for email, oldUser := range oldUsers {
+		if !partial && !oldUser.Admin && !oldUser.Staff && !onRoster[email] {
+			preview.Removed = append(preview.Removed, oldUser)
+		}
+	}
+
+	for email, list := range entries {
+		if partial || len(list) == 0 || onRoster[email] {
+			continue
+		}
+		if _, ok := archive[email]; ok {
+			continue
+		}
+		// Admins are kept and removed students are archived
+		if _, ok := oldUsers[email]; ok {
+			continue
+		}
+		preview.Orphaned = append(preview.Orphaned, email)
+	}
+
+	byName := func(list []User) {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Name < list[j].Name
+		})
+	}
+	byName(preview.Added)
+	byName(preview.Removed)
+	sort.Slice(preview.Changed, func(i, j int) bool {
+		return preview.Changed[i].New.Name < preview.Changed[j].New.Name
+	})
+	sort.Strings(preview.Orphaned)
+
+	return preview
+}
+
+// Method Expired returns whether a preview is too old to be applied.
+func (p *RosterPreview) Expired(t time.Time) bool {
+	return t.Sub(p.Created) > ROSTER_PREVIEW_EXPIRY
+}
@@ -24,13 +24,18 @@ func NewTokenMap() *TokenMap {
 	}
 }
 
-// doesn't lock
-func (m *TokenMap) newToken() string {
+// Function randomToken returns a random 256-bit string.
+func randomToken() string {
 	num, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(2), big.NewInt(256), nil))
 	if err != nil {
-		return m.newToken()
+		return randomToken()
 	}
-	token := num.Text(36)
+	return num.Text(36)
+}
+
+// doesn't lock
+func (m *TokenMap) newToken() string {
+	token := randomToken()
 	if _, ok := m.m[token]; ok {
 		return m.newToken()
 	}
@@ -61,6 +66,17 @@ func (m *TokenMap) Remove(token string) {
 	m.mutex.Unlock()
 }
 
+// Method RemoveUser signs a user out everywhere, so that changes to their roles take effect.
+func (m *TokenMap) RemoveUser(email string) {
+	m.mutex.Lock()
+	for token, user := range m.m {
+		if user.Email == email {
+			delete(m.m, token)
+		}
+	}
+	m.mutex.Unlock()
+}
+
 func (m *TokenMap) Get(token string) (User, bool) {
 	m.mutex.RLock()
 	user, ok := m.m[token]
@@ -94,6 +110,9 @@ func tmUserFromGToken(token string, database *Database, domain string) (User, er
 		return User{}, errors.New("that account isn't associated with Blind Brook")
 	}
 	out := database.User(fmt.Sprint(data["email"]))
+	if out.Disabled {
+		return User{}, errors.New("that account has been disabled")
+	}
 
 	// Create User struct if not found in map; fmt.Sprint converts things to strings (just in case it's not a string)
 	if out.Name == out.Email || out.Name == "" {
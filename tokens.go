@@ -0,0 +1,222 @@
+package main
+
+/* Personal API tokens
+ *
+ * Users can create tokens for scripts and integrations. A token is sent as "Authorization: Bearer <token>"
+ * and acts as the user who created it, limited by its scope. Only a hash of each token is stored.
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TOKEN_READ_ONLY     = "read-only"     // Can only view
+	TOKEN_ENTRIES_WRITE = "entries-write" // Can also add, change, and (as an admin) delete entries
+	TOKEN_ROSTER_ADMIN  = "roster-admin"  // Can do everything the user can. Only for Admin users
+)
+
+// Every token starts with this, so that tokens can be recognized
+const TOKEN_PREFIX = "bbcs_"
+
+var (
+	TokenScope   = errors.New("this token's scope does not allow that")
+	TokenInvalid = errors.New("invalid or expired token")
+)
+
+// Paths that change entries, which tokens with TOKEN_ENTRIES_WRITE may POST to. Reviewing deletion requests and
+// unflagging entries are reviews, so they need TOKEN_ROSTER_ADMIN.
+var tokenEntryPaths = map[string]bool{
+	"/do/add":              true,
+	"/do/comment":          true,
+	"/do/withdraw":         true,
+	"/do/deletion/request": true,
+	"/do/update":           true,
+	"/do/delete":           true,
+}
+
+// Scopes that tokens need to GET routes, by path template. Routes that aren't listed, such as /tokens, which shows
+// new tokens, can't be read with a token.
+var tokenReadScopes = map[string]string{
+	"/":                                   TOKEN_READ_ONLY,
+	"/generator":                          TOKEN_READ_ONLY,
+	"/add":                                TOKEN_ENTRIES_WRITE,
+	"/all":                                TOKEN_READ_ONLY,
+	"/all/flagged":                        TOKEN_READ_ONLY,
+	"/all/certify":                        TOKEN_READ_ONLY,
+	"/all/certify.csv":                    TOKEN_READ_ONLY,
+	"/all/progress":                       TOKEN_READ_ONLY,
+	"/all/awards":                         TOKEN_READ_ONLY,
+	"/all/awards.csv":                     TOKEN_READ_ONLY,
+	"/all/audit":                          TOKEN_READ_ONLY,
+	"/all/audit.csv":                      TOKEN_READ_ONLY,
+	"/all/trash":                          TOKEN_READ_ONLY,
+	"/all/archive":                        TOKEN_READ_ONLY,
+	"/all/staff":                          TOKEN_READ_ONLY,
+	"/all/webhooks":                       TOKEN_READ_ONLY,
+	"/all/reminders":                      TOKEN_READ_ONLY,
+	"/all/reminders/preview":              TOKEN_READ_ONLY,
+	"/roster":                             TOKEN_READ_ONLY,
+	"/roster/preview":                     TOKEN_READ_ONLY,
+	"/roster/{email}":                     TOKEN_READ_ONLY,
+	"/settings":                           TOKEN_READ_ONLY,
+	"/notifications":                      TOKEN_READ_ONLY,
+	"/{email}":                            TOKEN_READ_ONLY,
+	"/{email}/{key}":                      TOKEN_READ_ONLY,
+	"/{email}/{key}/duplicate":            TOKEN_ENTRIES_WRITE,
+	"/api/v1/users":                       TOKEN_READ_ONLY,
+	"/api/v1/users/{email}":               TOKEN_READ_ONLY,
+	"/api/v1/users/{email}/total":         TOKEN_READ_ONLY,
+	"/api/v1/users/{email}/entries":       TOKEN_READ_ONLY,
+	"/api/v1/users/{email}/entries/{key}": TOKEN_READ_ONLY,
+	"/api/v1/totals":                      TOKEN_READ_ONLY,
+	"/api/v1/flagged":                     TOKEN_READ_ONLY,
+}
+
+// Each scope allows everything that the scopes ranked below it do
+var tokenScopeRank = map[string]int{
+	TOKEN_READ_ONLY:     1,
+	TOKEN_ENTRIES_WRITE: 2,
+	TOKEN_ROSTER_ADMIN:  3,
+}
+
+// returns whether a scope allows everything that another scope does.
+func tokenScopeIncludes(scope string, other string) bool {
+	return tokenScopeRank[scope] != 0 && tokenScopeRank[scope] >= tokenScopeRank[other]
+}
+
+// Type APIToken is a personal API token.
+type APIToken struct {
+	ID       string    `json:"-"`    // Hash of the token, which is its key in the database
+	User     string    `json:"user"` // ID of the user
+	Name     string    `json:"name"`
+	Scope    string    `json:"scope"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires,omitempty"` // Zero if the token never expires
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+// Function TokenScopes returns the scopes that a user can give their tokens.
+func TokenScopes(user User) []string {
+	if user.Admin {
+		return []string{TOKEN_READ_ONLY, TOKEN_ENTRIES_WRITE, TOKEN_ROSTER_ADMIN}
+	}
+	return []string{TOKEN_READ_ONLY, TOKEN_ENTRIES_WRITE}
+}
+
+// returns the hash of a token, which is stored instead of the token.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Function NewAPIToken creates a token. Returns the token, which is only shown once, and its record.
+func NewAPIToken(name string, scope string, expires time.Time) (string, *APIToken) {
+	secret := TOKEN_PREFIX + randomToken()
+	return secret, &APIToken{
+		ID:      tokenHash(secret),
+		Name:    name,
+		Scope:   scope,
+		Created: time.Now(),
+		Expires: expires,
+	}
+}
+
+// Method Expired returns whether the token has expired at a given instant.
+func (t *APIToken) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && now.After(t.Expires)
+}
+
+// Method Allows returns whether the token's scope allows a request. GET requests need the scope in tokenReadScopes,
+// and tokens can never be used to manage tokens.
+func (t *APIToken) Allows(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/do/tokens") || r.URL.Path == "/signout" {
+		return false
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			return false
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return false
+		}
+		scope, ok := tokenReadScopes[path]
+		return ok && tokenScopeIncludes(t.Scope, scope)
+	}
+
+	switch t.Scope {
+	case TOKEN_ROSTER_ADMIN:
+		return true
+	case TOKEN_ENTRIES_WRITE:
+		api := strings.HasPrefix(r.URL.Path, "/api/v1/users/") && strings.Contains(r.URL.Path, "/entries") && !strings.HasSuffix(r.URL.Path, "/unflag")
+		return tokenEntryPaths[r.URL.Path] || api
+	}
+	return false
+}
+
+// returns the bearer token of a request, if there is one.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// Type NewTokens holds newly created tokens until they are shown to the users who created them.
+type NewTokens struct {
+	m     map[string]newToken
+	mutex *sync.Mutex
+}
+
+type newToken struct {
+	email   string
+	secret  string
+	created time.Time
+}
+
+func NewNewTokens() *NewTokens {
+	return &NewTokens{
+		m:     make(map[string]newToken),
+		mutex: new(sync.Mutex),
+	}
+}
+
+// Method Add stores a token for a user and returns an ID to show it with. Tokens that haven't been shown
+// within 10 minutes are discarded.
+func (n *NewTokens) Add(email string, secret string) string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for id, old := range n.m {
+		if time.Since(old.created) > 10*time.Minute {
+			delete(n.m, id)
+		}
+	}
+
+	id := randomToken()
+	n.m[id] = newToken{email: email, secret: secret, created: time.Now()}
+	return id
+}
+
+// Method Take returns a token and forgets it, so that it is only shown once.
+func (n *NewTokens) Take(email string, id string) (string, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	token, ok := n.m[id]
+	if !ok || token.email != email {
+		return "", false
+	}
+	delete(n.m, id)
+	return token.secret, true
+}
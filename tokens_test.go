@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestTokenReadScopes(t *testing.T) {
+	for _, route := range apiRoutes {
+		if route.Method == "GET" && tokenReadScopes[route.Path] == "" {
+			t.Errorf("GET %s has no token scope", route.Path)
+		}
+	}
+
+	for _, c := range []struct {
+		scope, other string
+		allowed      bool
+	}{
+		{TOKEN_READ_ONLY, TOKEN_READ_ONLY, true},
+		{TOKEN_READ_ONLY, TOKEN_ENTRIES_WRITE, false},
+		{TOKEN_ENTRIES_WRITE, TOKEN_READ_ONLY, true},
+		{TOKEN_ROSTER_ADMIN, TOKEN_ENTRIES_WRITE, true},
+		{"unknown", TOKEN_READ_ONLY, false},
+	} {
+		if tokenScopeIncludes(c.scope, c.other) != c.allowed {
+			t.Errorf("tokenScopeIncludes(%q, %q) != %v", c.scope, c.other, c.allowed)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+/* Trash
+ *
+ * Deleted entries are moved to the trash, along with who deleted them and why. Admins can restore them or purge
+ * them for good, and they are purged automatically once they have been in the trash for the retention period
+ * ($BBCS_TRASH_RETENTION).
+ */
+
+import (
+	"time"
+)
+
+// Type TrashedEntry is an entry in the trash.
+type TrashedEntry struct {
+	Email     string    `json:"-"`
+	Key       string    `json:"-"`
+	Entry     *Entry    `json:"entry"`
+	DeletedBy string    `json:"deleted_by"`
+	Reason    string    `json:"reason,omitempty"`
+	Deleted   time.Time `json:"deleted"`
+
+	userID string
+}
+
+// Method PurgeAt returns when the entry is purged automatically.
+func (t TrashedEntry) PurgeAt(retention time.Duration) time.Time {
+	return t.Deleted.Add(retention)
+}
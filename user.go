@@ -4,17 +4,41 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type User struct {
+	ID    string `json:"-"`     // Database key, which never changes
 	Name  string `json:"name"`  // Name
 	Grade uint   `json:"grade"` // Graduation Year
 	Email string `json:"email"` // Email
 	Late  uint   `json:"late"`  // Years Late
 	Admin bool   `json:"admin"` // User type: true for admin, false for student
+
+	Staff    bool `json:"staff,omitempty"`    // Staff members, such as advisors, are not students and are never archived
+	Disabled bool `json:"disabled,omitempty"` // Disabled users cannot sign in
+
+	StudentID string `json:"student_id,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	Homeroom  string `json:"homeroom,omitempty"`
+	Counselor string `json:"counselor,omitempty"`
+	Advisor   string `json:"advisor,omitempty"`
+}
+
+// adds the problems with the user's name and email to problems.
+func (u User) validate(problems ValidationError) {
+	if strings.TrimSpace(u.Name) == "" {
+		problems.Add("name", "name is missing")
+	}
+	if u.Email == "" {
+		problems.Add("email", "email is missing")
+	} else if !validEmail(u.Email) {
+		problems.Add("email", fmt.Sprintf("invalid email: '%v'", u.Email))
+	}
 }
 
 // Method GradeNow returns the grade of the user
@@ -35,46 +59,229 @@ func (u User) GradeAt(t time.Time) uint {
 	return grade
 }
 
+// Function ClassOf returns the graduation year of students who are in a given grade at a given instant
+func ClassOf(grade uint, t time.Time) uint {
+	class := uint(t.Year()) + 12 - grade
+	if t.Month() >= time.July {
+		class += 1
+	}
+	return class
+}
+
 // Method Required returns the # of hours that the student should do
 func (u User) Required() uint {
-	return (u.GradeNow() - 8 - u.Late) * 20
+	return u.RequiredBy(u.GradeNow())
 }
 
-func UsersFromCSV(r io.Reader) ([]User, error) {
-	records, err := csv.NewReader(r).ReadAll()
-	if err != nil {
-		return nil, err
+// Method RequiredBy returns the # of hours that the student should have done by the end of a given grade
+func (u User) RequiredBy(grade uint) uint {
+	if grade < 8+u.Late {
+		return 0
 	}
+	return (grade - 8 - u.Late) * 20
+}
 
-	if len(records) != 0 && len(records[0]) != 0 && strings.EqualFold(records[0][0], "Name") {
-		records = records[1:]
+// Type RowError is an error in one row of a CSV file.
+type RowError struct {
+	File    string `json:"file,omitempty"` // Name of the file, if the roster has several
+	Line    int    `json:"line"`
+	Err     string `json:"err"`
+	Teacher bool   `json:"teacher,omitempty"` // The row is a teacher's, so the roster can be applied without it
+}
+
+func (e RowError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s line %d: %s", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// Variable RosterAliases maps each roster column to the headers that it may have. Headers are compared case-insensitively.
+var RosterAliases = map[string][]string{
+	"name":       {"name", "full name", "student name", "student"},
+	"first_name": {"first name", "first", "given name"},
+	"last_name":  {"last name", "last", "surname", "family name"},
+	"grade":      {"graduation year", "grad year", "grad", "graduation", "class", "class of", "year of graduation", "yog"},
+	"email":      {"email", "e-mail", "email address", "e-mail address", "student email", "mail"},
+	"late":       {"late", "years late", "# of years late", "# years late", "# late", "late years"},
+	"student_id": {"student id", "id", "student number"},
+	"homeroom":   {"homeroom"},
+	"counselor":  {"counselor", "guidance counselor"},
+	"advisor":    {"advisor", "adviser"},
+}
+
+// Function AddRosterAliases adds header aliases formatted as "column=alias|alias;column=alias".
+func AddRosterAliases(s string) error {
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		column := strings.TrimSpace(kv[0])
+		if _, ok := RosterAliases[column]; !ok || len(kv) != 2 {
+			return fmt.Errorf("invalid roster alias: '%v'", part)
+		}
+		for _, alias := range strings.Split(kv[1], "|") {
+			RosterAliases[column] = append(RosterAliases[column], strings.ToLower(strings.TrimSpace(alias)))
+		}
+	}
+	return nil
+}
+
+// returns whether the columns that every roster needs were found.
+func rosterComplete(columns map[string]int) bool {
+	_, name := columns["name"]
+	_, first := columns["first_name"]
+	_, last := columns["last_name"]
+	_, grade := columns["grade"]
+	_, email := columns["email"]
+	return (name || (first && last)) && grade && email
+}
+
+// finds the column of each header. ok is false if none of the headers are recognized.
+func rosterHeader(header []string) (columns map[string]int, ok bool) {
+	columns = make(map[string]int)
+	for i, cell := range header {
+		cell = strings.ToLower(strings.TrimSpace(cell))
+		for column, aliases := range RosterAliases {
+			for _, alias := range aliases {
+				if _, dup := columns[column]; cell == alias && !dup {
+					columns[column] = i
+				}
+			}
+		}
+	}
+	return columns, len(columns) != 0
+}
+
+// Function UsersFromCSV reads a roster. If the first row is a header, columns may be in any order, and columns
+// that are not in RosterAliases are ignored. Otherwise, there must be 4 columns: name, graduation year, email,
+// # of years late.
+//
+// Rows that cannot be read are skipped and returned as RowErrors; an error is only returned if the file as a
+// whole cannot be read.
+func UsersFromCSV(r io.Reader) ([]User, []RowError, error) {
+	// Quoted fields may span several lines, so the line of each record comes from the reader
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records := [][]string(nil)
+	lines := []int(nil)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		records = append(records, record)
+		lines = append(lines, line)
 	}
 
 	if len(records) == 0 {
-		return nil, fmt.Errorf("no users found")
+		return nil, nil, fmt.Errorf("no users found")
+	}
+
+	width := 4
+	legacy := map[string]int{"name": 0, "grade": 1, "email": 2, "late": 3}
+	columns, ok := rosterHeader(records[0])
+	if ok {
+		// Before columns were read by header, a header only had to start with "Name", and the columns were in
+		// the same order as a file without a header
+		header := records[0]
+		if !rosterComplete(columns) && len(header) == 4 && strings.EqualFold(strings.TrimSpace(header[0]), "name") {
+			columns = legacy
+		}
+		width = len(header)
+		records = records[1:]
+		lines = lines[1:]
+	} else {
+		columns = legacy
+	}
+
+	if _, ok := columns["email"]; !ok {
+		return nil, nil, fmt.Errorf("missing column: email")
+	}
+	if _, ok := columns["grade"]; !ok {
+		return nil, nil, fmt.Errorf("missing column: graduation year")
+	}
+	_, first := columns["first_name"]
+	_, last := columns["last_name"]
+	if _, ok := columns["name"]; !ok && !(first && last) {
+		return nil, nil, fmt.Errorf("missing column: name")
 	}
 
-	if len(records[0]) != 4 {
-		return nil, fmt.Errorf("wrong number of fields")
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("no users found")
 	}
 
 	out := []User(nil)
-	for _, record := range records {
-		user := User{}
-		user.Name = record[0]
-		grade, err := strconv.ParseUint(record[1], 10, 32)
-		if err != nil {
-			return nil, fmt.Errorf("invalid graduation year: '%v'", record[1])
+	rowErrors := []RowError(nil)
+	for i, record := range records {
+		if len(record) != width {
+			rowErrors = append(rowErrors, RowError{Line: lines[i], Err: "wrong number of fields"})
+			continue
 		}
-		user.Grade = uint(grade)
-		user.Email = record[2]
-		late, err := strconv.ParseUint(record[3], 10, 8)
+		user, err := userFromRecord(record, columns)
 		if err != nil {
-			return nil, fmt.Errorf("invalid # of years late: '%v'", record[3])
+			rowErrors = append(rowErrors, RowError{Line: lines[i], Err: err.Error()})
+			continue
 		}
-		user.Late = uint(late)
 		out = append(out, user)
 	}
 
-	return out, nil
+	return out, rowErrors, nil
+}
+
+// converts a row of a roster into a User.
+func userFromRecord(record []string, columns map[string]int) (User, error) {
+	return userFromFields(func(column string) string {
+		if i, ok := columns[column]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	})
+}
+
+// Function UserFromQuery reads a student from a form whose fields are named after the columns in RosterAliases.
+func UserFromQuery(query url.Values) (User, error) {
+	return userFromFields(func(column string) string {
+		return strings.TrimSpace(query.Get(column))
+	})
+}
+
+// converts the columns of a roster into a User. get returns the value of a column. The error is a ValidationError,
+// and the user is returned with it so that the form can be filled in again.
+func userFromFields(get func(column string) string) (User, error) {
+	user := User{
+		Name:      get("name"),
+		Email:     get("email"),
+		StudentID: get("student_id"),
+		FirstName: get("first_name"),
+		LastName:  get("last_name"),
+		Homeroom:  get("homeroom"),
+		Counselor: get("counselor"),
+		Advisor:   get("advisor"),
+	}
+	if user.Name == "" {
+		user.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	}
+	problems := make(ValidationError)
+	user.validate(problems)
+
+	grade, err := strconv.ParseUint(get("grade"), 10, 32)
+	if err != nil {
+		problems.Add("grade", fmt.Sprintf("invalid graduation year: '%v'", get("grade")))
+	}
+	user.Grade = uint(grade)
+
+	if late := get("late"); late != "" {
+		n, err := strconv.ParseUint(late, 10, 8)
+		if err != nil {
+			problems.Add("late", fmt.Sprintf("invalid # of years late: '%v'", late))
+		}
+		user.Late = uint(n)
+	}
+	return user, problems.Err()
 }
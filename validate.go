@@ -0,0 +1,53 @@
+package main
+
+/* Validation
+ *
+ * Entries and users are checked before they are saved. Problems are returned as a ValidationError, which maps
+ * each field, named as it is in JSON, to a message. Forms show each message next to its field, and the API
+ * returns them as "fields".
+ */
+
+import (
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+// Type ValidationError maps fields to what is wrong with them.
+type ValidationError map[string]string
+
+func (e ValidationError) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	messages := make([]string, len(fields))
+	for i, field := range fields {
+		messages[i] = e[field]
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Method Add records a problem with a field. Only the first problem with each field is kept.
+func (e ValidationError) Add(field string, message string) {
+	if _, ok := e[field]; !ok {
+		e[field] = message
+	}
+}
+
+// Method Err returns nil if there are no problems, and the ValidationError otherwise.
+func (e ValidationError) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// returns whether a string is an email address alone, such as "name@example.org". Users' emails are used as
+// database keys, so addresses with characters that keys can't have are rejected too.
+func validEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s && !strings.ContainsAny(s, "#$[]/")
+}
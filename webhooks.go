@@ -0,0 +1,272 @@
+package main
+
+/* Webhooks
+ *
+ * Events are sent to webhook endpoints as signed HTTP POSTs. Each event is first written to an outbox in the
+ * database as a delivery, so that it is sent even if the server restarts. Failed deliveries are retried with
+ * exponential backoff, and every delivery is kept for a while as a log.
+ *
+ * The body is the event as JSON. The X-BBCS-Signature header is "sha256=" followed by the hex HMAC-SHA256 of
+ * the X-BBCS-Timestamp header, a period, and the body, keyed with the endpoint's secret.
+ */
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_FAILED    = "failed" // Gave up after WEBHOOK_ATTEMPTS attempts
+)
+
+const (
+	WEBHOOK_ATTEMPTS  = 8           // Attempts before a delivery fails; the last retry is about 2 hours after the first attempt
+	WEBHOOK_BACKOFF   = time.Minute // Delay before the first retry, which doubles after every attempt
+	WEBHOOK_RETENTION = 30 * 24 * time.Hour
+)
+
+// Sent to endpoints to check that they work. Endpoints do not subscribe to it.
+const EVENT_PING = "ping"
+
+// Type Webhook is an endpoint that receives events.
+type Webhook struct {
+	ID       string    `json:"-"`
+	URL      string    `json:"url"`
+	Secret   string    `json:"secret"`
+	Events   []string  `json:"events"`
+	Disabled bool      `json:"disabled,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// Method Subscribed returns whether the endpoint receives a type of event.
+func (w Webhook) Subscribed(eventType string) bool {
+	if w.Disabled {
+		return false
+	}
+	for _, t := range w.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Type Delivery is an event that is sent or will be sent to an endpoint.
+type Delivery struct {
+	ID          string    `json:"-"`
+	Webhook     string    `json:"webhook"` // ID of the endpoint
+	Event       string    `json:"event"`   // Type of the event
+	Payload     string    `json:"payload"` // Body of the request
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastStatus  int       `json:"last_status,omitempty"` // HTTP status code of the last attempt
+	LastError   string    `json:"last_error,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// Function ParseWebhook validates an endpoint from the form on the Webhooks page.
+func ParseWebhook(query url.Values) (Webhook, error) {
+	u, err := url.Parse(query.Get("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("invalid URL: '%v'", query.Get("url"))
+	}
+
+	webhook := Webhook{URL: u.String(), Created: time.Now()}
+	for _, t := range EventTypes {
+		if query.Get(t) != "" {
+			webhook.Events = append(webhook.Events, t)
+		}
+	}
+	if len(webhook.Events) == 0 {
+		return Webhook{}, fmt.Errorf("no events selected")
+	}
+	return webhook, nil
+}
+
+// Function NewDelivery creates a pending delivery of an event to an endpoint.
+func NewDelivery(webhook Webhook, event Event) (Delivery, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return Delivery{}, err
+	}
+	return Delivery{
+		ID:          dbNewID(),
+		Webhook:     webhook.ID,
+		Event:       event.Type,
+		Payload:     string(payload),
+		Status:      DELIVERY_PENDING,
+		NextAttempt: event.Time,
+		Created:     event.Time,
+	}, nil
+}
+
+// Function WebhookSignature returns the value of the X-BBCS-Signature header.
+func WebhookSignature(secret string, timestamp string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp+"."+payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Method Attempt sends a delivery to its endpoint and records the result. After a failed attempt, the next
+// attempt is scheduled, unless there have been WEBHOOK_ATTEMPTS attempts.
+func (d *Delivery) Attempt(webhook Webhook, now time.Time) {
+	d.Attempts++
+	d.LastStatus = 0
+	d.LastError = ""
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewBufferString(d.Payload))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "BBCS-Webhooks/1")
+		req.Header.Set("X-BBCS-Event", d.Event)
+		req.Header.Set("X-BBCS-Delivery", d.ID)
+		req.Header.Set("X-BBCS-Timestamp", timestamp)
+		req.Header.Set("X-BBCS-Signature", WebhookSignature(webhook.Secret, timestamp, d.Payload))
+
+		var resp *http.Response
+		resp, err = webhookClient.Do(req)
+		if err == nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+			d.LastStatus = resp.StatusCode
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				err = fmt.Errorf("endpoint responded with %s", resp.Status)
+			}
+		}
+	}
+
+	switch {
+	case err == nil:
+		d.Status = DELIVERY_DELIVERED
+	case d.Attempts >= WEBHOOK_ATTEMPTS:
+		d.Status = DELIVERY_FAILED
+		d.LastError = err.Error()
+	default:
+		d.LastError = err.Error()
+		d.NextAttempt = now.Add(WEBHOOK_BACKOFF << uint(d.Attempts-1))
+	}
+}
+
+// queues an event for every endpoint that is subscribed to it. The deliveries are written to the outbox before the
+// event's publisher continues, and sent in the background.
+func queueWebhooks(event Event) {
+	webhooks, err := database.Webhooks()
+	if err != nil {
+		log.Printf("webhooks: %v", err)
+		return
+	}
+
+	deliveries := []Delivery(nil)
+	for _, webhook := range webhooks {
+		if !webhook.Subscribed(event.Type) {
+			continue
+		}
+		delivery, err := NewDelivery(webhook, event)
+		if err != nil {
+			log.Printf("webhooks: %v", err)
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+
+	err = database.AddDeliveries(deliveries)
+	if err != nil {
+		log.Printf("webhooks: %v", err)
+		return
+	}
+	go DeliverWebhooks()
+}
+
+var (
+	delivering      = make(map[string]bool) // Endpoints whose deliveries are being sent
+	deliveringMutex sync.Mutex
+)
+
+// Function DeliverWebhooks attempts every pending delivery that is due. Each endpoint's deliveries are sent in
+// order, in a goroutine of their own, so that a slow endpoint doesn't hold up the others. Endpoints whose
+// deliveries are still being sent from an earlier call are skipped, and deliveries to endpoints that were
+// removed are deleted.
+func DeliverWebhooks() {
+	webhooks, err := database.Webhooks()
+	if err != nil {
+		log.Printf("webhooks: %v", err)
+		return
+	}
+
+	// Endpoints are claimed before their deliveries are read, so that no delivery is read while it's being sent
+	claimed := make(map[string]bool)
+	deliveringMutex.Lock()
+	for id, webhook := range webhooks {
+		if !delivering[id] && !webhook.Disabled {
+			delivering[id] = true
+			claimed[id] = true
+		}
+	}
+	deliveringMutex.Unlock()
+	release := func(id string) {
+		deliveringMutex.Lock()
+		delete(delivering, id)
+		deliveringMutex.Unlock()
+	}
+
+	deliveries, err := database.PendingDeliveries()
+	if err != nil {
+		log.Printf("webhooks: %v", err)
+		deliveries = nil
+	}
+
+	now := time.Now()
+	due := make(map[string][]Delivery)
+	removed := []string(nil)
+	for _, delivery := range deliveries {
+		if _, ok := webhooks[delivery.Webhook]; !ok {
+			removed = append(removed, delivery.ID)
+			continue
+		}
+		if claimed[delivery.Webhook] && !delivery.NextAttempt.After(now) {
+			due[delivery.Webhook] = append(due[delivery.Webhook], delivery)
+		}
+	}
+	if len(removed) != 0 {
+		if err := database.RemoveDeliveries(removed); err != nil {
+			log.Printf("webhooks: %v", err)
+		}
+	}
+
+	for id := range claimed {
+		if len(due[id]) == 0 {
+			release(id)
+			continue
+		}
+		go func(webhook Webhook, deliveries []Delivery) {
+			defer release(webhook.ID)
+			for _, delivery := range deliveries {
+				delivery.Attempt(webhook, time.Now())
+				if err := database.SetDelivery(delivery); err != nil {
+					log.Printf("webhooks: %v", err)
+				}
+			}
+		}(webhooks[id], due[id])
+	}
+}